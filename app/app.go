@@ -20,19 +20,21 @@ import (
 	"io/ioutil"
 	"k8s.io/client-go/kubernetes/scheme"
 	"net"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
 	v1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
@@ -48,6 +50,34 @@ const (
 	mongoDBCollectionNameCluster = "bcsclustermanagerv2_cluster"
 )
 
+// Command sub commands of the migrate tool
+const (
+	// CommandPreflight check endpoints, credentials, the cert secret and the kube agent image, read only
+	CommandPreflight = "preflight"
+	// CommandPlan inspect the old environment and show what migrate would do, read only
+	CommandPlan = "plan"
+	// CommandMigrate migrate projects, clusters and deploy bcs kube agent
+	CommandMigrate = "migrate"
+	// CommandVerify verify migrated clusters and new bcs kube agent
+	CommandVerify = "verify"
+	// CommandRollback remove the new bcs kube agent from migrated clusters
+	CommandRollback = "rollback"
+	// CommandCleanup back up and remove the old bcs kube agent and bcs k8s watch in migrated clusters
+	CommandCleanup = "cleanup"
+	// CommandRestore restore the old bcs kube agent and bcs k8s watch from backups of cleanup
+	CommandRestore = "restore"
+	// CommandSimulate run migrate, verify and rollback end to end against local stand-ins of all services
+	CommandSimulate = "simulate"
+)
+
+// Commands all available sub commands
+var Commands = []string{CommandPreflight, CommandPlan, CommandMigrate, CommandVerify, CommandRollback,
+	CommandCleanup, CommandRestore, CommandSimulate}
+
+const (
+	oldKubeAgentName = "bcs-kube-agent"
+)
+
 const (
 	defaultEsbURL         = "http://9.140.129.207:8081"
 	defaultWebhookImage   = "xxx.com:8090/public/bcs/k8s/bcs-webhook-server:1.2.0"
@@ -56,118 +86,331 @@ const (
 
 // App for app
 type App struct {
-	op          *options.UpgradeOption
-	sqlClient   *gorm.DB
-	mongoClient *mongo.Client
+	op        *options.UpgradeOption
+	sqlClient *gorm.DB
+	// store of clusters, run lock and counters in mongoDB
+	store   store
+	journal *journal
+	report  *report
+	// overrides of clusters keyed by clusterID in 1.18
+	overrides map[string]options.ClusterOverride
+	// clients of apis, created by initClients unless they are set, e.g. to fakes
+	projectManager components.ProjectManager
+	clusterManager components.ClusterManager
+	bcsCc          components.BCSCc
+	// closers of clients created by initClients, clients set before are kept open
+	closers []func()
+	// discoverErr error of discovering values left empty in config, reported by preflight
+	discoverErr error
+
+	// changes and clusters that would be made in dry run mode
+	dryRunLock    sync.Mutex
+	dryRunChanges []string
 }
 
 // NewApp create App
 func NewApp(op *options.UpgradeOption) *App {
 	return &App{
-		op: op,
+		op:     op,
+		report: newReport(CommandMigrate, op.DryRun),
+	}
+}
+
+// Run run the sub command and write its report, empty command means migrate
+func (app *App) Run(ctx context.Context, command string) error {
+	if command == "" {
+		command = CommandMigrate
+	}
+	known := false
+	for _, c := range Commands {
+		known = known || c == command
+	}
+	if !known {
+		return fmt.Errorf("unknown command %s, available commands: %s", command, strings.Join(Commands, ", "))
+	}
+	blog.Infof("running command %s", command)
+
+	app.report = newReport(command, app.op.DryRun || command == CommandPlan || command == CommandPreflight)
+	overrides, err := loadOverrides(app.op.OverridesPath)
+	if err == nil {
+		err = checkClusterWriteMode(app.op)
+	}
+	if err == nil {
+		err = checkFilter(app.op)
+	}
+	// simulate runs against its own stand-ins, nothing to discover, preflight reports the error in its table
+	if err == nil && command != CommandSimulate {
+		app.discoverErr = app.discover(ctx)
+		if command != CommandPreflight {
+			err = app.discoverErr
+		}
+		if err != nil {
+			app.closeClients()
+		}
+	}
+	if err == nil {
+		app.overrides = overrides
+		err = app.run(ctx, command)
+	}
+	if err != nil {
+		app.report.Error = err.Error()
+	}
+	blog.Infof("%s finished: %v", command, app.report.summary())
+	if werr := app.report.write(app.op.Report); werr != nil {
+		blog.Errorf("write report failed, %v", werr)
+	}
+
+	return err
+}
+
+func (app *App) run(ctx context.Context, command string) error {
+	switch command {
+	case CommandPreflight:
+		return app.DoPreflight(ctx)
+	case CommandPlan:
+		return app.DoPlan(ctx)
+	case CommandMigrate:
+		return app.DoMigrate(ctx)
+	case CommandVerify:
+		return app.DoVerify(ctx)
+	case CommandRollback:
+		return app.DoRollback(ctx)
+	case CommandCleanup:
+		return app.DoCleanup(ctx)
+	case CommandRestore:
+		return app.DoRestore(ctx)
+	case CommandSimulate:
+		return app.DoSimulate(ctx)
+	default:
+		return fmt.Errorf("unknown command %s", command)
 	}
 }
 
 // DoMigrate migrate data and deploy bcs components
-func (app *App) DoMigrate() error {
-	err := app.initMysqlClient()
+func (app *App) DoMigrate(ctx context.Context) error {
+	err := app.initClients()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err = app.sqlClient.Close()
-		if err != nil {
-			blog.Errorf("disconnect mysql failed, %v", err)
+	defer app.closeClients()
+
+	if !app.op.DryRun && !app.op.SkipPreflight {
+		if err = app.runPreflight(ctx); err != nil {
+			return fmt.Errorf("%v, fix them or set skip_preflight", err)
 		}
-	}()
-	app.sqlClient.AutoMigrate(&types.Project{}, &types.Cluster{})
+	}
 
-	err = app.initMongoClient()
+	ctx, unlock, err := app.lockRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if app.op.DryRun {
+		blog.Infof("dry run mode enabled, nothing will be changed")
+	}
+
+	app.journal, err = loadJournal(app.op.JournalPath, app.op.DryRun)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err = app.mongoClient.Disconnect(context.Background())
-		if err != nil {
-			blog.Errorf("disconnect mongoDB failed, %v", err)
-		}
-	}()
 
 	if app.op.MigrateProjectData {
-		err = app.migrateProjects()
+		err = app.migrateProjects(ctx)
 		if err != nil {
 			return err
 		}
 	}
 
-	// migrate clusters in normal status
-	successClusters, changedClusters, err := app.migrateClusters()
+	clusters, err := app.listClusters(ctx)
 	if err != nil {
 		return err
 	}
+	blog.Infof("got %d clusters from database", len(clusters))
 
-	blog.Debug("got %d changed clusters: %v", len(changedClusters), changedClusters)
+	snapshot, err := app.loadClusterSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("list clusters in cluster manager failed, %v", err)
+	}
+	changedClusters := newClusterIDMapping()
 
-	// deploy bcs kube agent
-	if app.op.KubeAgent.Enable {
-		blog.Infof("deploy new bcs kube agent enabled")
+	if app.op.Wave.Enable {
+		err = app.rolloutWaves(ctx, clusters, snapshot, changedClusters)
+	} else {
+		err = app.migrateAll(ctx, clusters, snapshot, changedClusters)
+	}
+	if app.op.DryRun {
+		app.printDryRunChanges()
+	}
+	return err
+}
 
-		blog.Infof("will deploy new bcs kube agent on %d clusters", len(successClusters))
-		for _, c := range successClusters {
-			err := deployKubeAgent(app.op, c, changedClusters)
+// migrateAll migrate all clusters and deploy bcs components on them at once
+func (app *App) migrateAll(ctx context.Context, clusters []types.Cluster, snapshot *clusterSnapshot,
+	changedClusters *clusterIDMapping) error {
+	successClusters, _ := app.migrateClusters(ctx, clusters, snapshot, changedClusters)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	blog.V(3).Infof("got %d changed clusters: %v", len(changedClusters.all()), changedClusters.all())
+
+	failed := app.deployComponents(ctx, successClusters, changedClusters)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d clusters failed to deploy new bcs components: %v", len(failed),
+			clusterIDsOf(failed))
+	}
+	return nil
+}
+
+// deployComponents deploy bcs kube agent and bcs k8s watch on clusters, errors are keyed by clusterID
+func (app *App) deployComponents(ctx context.Context, clusters []types.ClusterM,
+	changedClusters *clusterIDMapping) map[string]string {
+	failedClusters := newClusterErrors()
+	if !app.op.KubeAgent.Enable && !app.op.K8SWatch.Enable {
+		return failedClusters.all()
+	}
+	blog.Infof("deploy new bcs kube agent enabled: %v, deploy new bcs k8s watch enabled: %v",
+		app.op.KubeAgent.Enable, app.op.K8SWatch.Enable)
+
+	blog.Infof("will deploy new bcs components on %d clusters", len(clusters))
+	app.parallelize(ctx, len(clusters), func(ctx context.Context, i int) {
+		c := clusters[i]
+		if app.op.KubeAgent.Enable {
+			err := app.deployKubeAgent(ctx, c, changedClusters)
 			if err != nil {
 				blog.Errorf("deploy kube agent for cluster %s failed, %v", c.ClusterID, err)
+				failedClusters.add(c.ClusterID, err)
+			}
+		}
+		if app.op.K8SWatch.Enable {
+			err := app.deployK8SWatch(ctx, c, changedClusters)
+			if err != nil {
+				blog.Errorf("deploy k8s watch for cluster %s failed, %v", c.ClusterID, err)
+				failedClusters.add(c.ClusterID, err)
 			}
 		}
+	})
+	return failedClusters.all()
+}
+
+// markProject record step of project in journal and report
+func (app *App) markProject(projectID, name, step, errMsg string) {
+	app.journal.markProject(projectID, name, step, errMsg)
+	app.report.recordProject(projectID, name, step, statusOf(errMsg), errMsg)
+}
+
+// markCluster record step of cluster in journal and report
+func (app *App) markCluster(originClusterID, clusterID, projectID, name, step, errMsg string) {
+	app.journal.markCluster(originClusterID, clusterID, projectID, name, step, errMsg)
+	app.report.recordCluster(originClusterID, clusterID, projectID, name, step, statusOf(errMsg), errMsg)
+}
+
+func statusOf(errMsg string) string {
+	if errMsg != "" {
+		return statusFailed
 	}
+	return statusSuccess
+}
 
-	return nil
+// recordChange record a change that would be made in dry run mode
+func (app *App) recordChange(format string, args ...interface{}) {
+	change := fmt.Sprintf(format, args...)
+	blog.Infof("[dry-run] %s", change)
+	app.dryRunLock.Lock()
+	defer app.dryRunLock.Unlock()
+	app.dryRunChanges = append(app.dryRunChanges, change)
 }
 
-func (app *App) migrateProjects() error {
-	projects := make([]types.Project, 0)
-	successProjects, failedProjects := make(map[string]string, 0), make(map[string]string, 0)
-	if len(app.op.ProjectIDs) != 0 {
-		app.sqlClient.Model(&types.Project{}).Where("project_id IN (?)", app.op.ProjectIDs).Find(&projects)
-	} else {
-		app.sqlClient.Model(&types.Project{}).Find(&projects)
+// planCluster record a cluster that would be imported in dry run mode
+func (app *App) planCluster(originClusterID string, cluster types.ClusterM) {
+	for _, step := range []string{stepClusterInserted, stepClusterSyncedToCc, stepClusterStatus} {
+		app.report.recordCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			step, statusPlanned, "")
+	}
+	masters := make([]string, 0, len(cluster.Master))
+	for ip := range cluster.Master {
+		masters = append(masters, ip)
 	}
+	sort.Strings(masters)
+	app.recordChange("insert cluster %s[%s] of project %s into cluster manager, masters %v",
+		cluster.ClusterName, cluster.ClusterID, cluster.ProjectID, masters)
+	app.recordChange("sync cluster %s[%s] to bcs cc and update status to normal",
+		cluster.ClusterName, cluster.ClusterID)
+}
+
+func (app *App) printDryRunChanges() {
+	blog.Infof("dry run finished, %d changes would be made:", len(app.dryRunChanges))
+	for i, change := range app.dryRunChanges {
+		blog.Infof("%d. %s", i+1, change)
+	}
+}
 
+func (app *App) migrateProjects(ctx context.Context) error {
+	successProjects, failedProjects := make(map[string]string, 0), make(map[string]string, 0)
+	projects, err := app.listProjects(ctx)
+	if err != nil {
+		return err
+	}
 	blog.Infof("got %d projects from database", len(projects))
 
 	for _, p := range projects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if app.journal.projectDone(p.ProjectID, stepProjectCreated) ||
+			app.journal.projectDone(p.ProjectID, stepProjectExisted) {
+			blog.Infof("project %s[%s] created already, skipping...", p.Name, p.ProjectID)
+			app.report.recordProject(p.ProjectID, p.Name, stepProjectCreated, statusSkipped, "")
+			successProjects[p.ProjectID] = p.Name
+			continue
+		}
+
 		dpt, _ := strconv.Atoi(p.DeployType)
-		_, err := components.CreateProject(app.op.BCSApiGateway.Addr, app.op.BCSApiGateway.Token, app.op.Debug,
-			&components.CreateProjectRequest{
-				Creator:     p.Creator,
-				ProjectID:   p.ProjectID,
-				Name:        p.Name,
-				ProjectCode: p.EnglishName,
-				UseBKRes:    p.UseBK,
-				Description: p.Description,
-				IsOffline:   p.IsOfflined,
-				Kind:        "k8s",
-				BusinessID:  strconv.Itoa(int(p.CCAppID)),
-				IsSecret:    p.IsSecrecy,
-				ProjectType: uint32(p.ProjectType),
-				DeployType:  uint32(dpt),
-				BGID:        strconv.Itoa(int(p.BGID)),
-				BGName:      p.BGName,
-				DeptID:      strconv.Itoa(int(p.DeptID)),
-				DeptName:    p.DeptName,
-				CenterID:    strconv.Itoa(int(p.CenterID)),
-				CenterName:  p.CenterName,
-			})
+		req := &components.CreateProjectRequest{
+			Creator:     p.Creator,
+			ProjectID:   p.ProjectID,
+			Name:        p.Name,
+			ProjectCode: p.EnglishName,
+			UseBKRes:    p.UseBK,
+			Description: p.Description,
+			IsOffline:   p.IsOfflined,
+			Kind:        "k8s",
+			BusinessID:  strconv.Itoa(int(p.CCAppID)),
+			IsSecret:    p.IsSecrecy,
+			ProjectType: uint32(p.ProjectType),
+			DeployType:  uint32(dpt),
+			BGID:        strconv.Itoa(int(p.BGID)),
+			BGName:      p.BGName,
+			DeptID:      strconv.Itoa(int(p.DeptID)),
+			DeptName:    p.DeptName,
+			CenterID:    strconv.Itoa(int(p.CenterID)),
+			CenterName:  p.CenterName,
+		}
+		if app.op.DryRun {
+			app.recordChange("create project %s[%s] with code %s and business %s in bcs project manager",
+				p.Name, p.ProjectID, req.ProjectCode, req.BusinessID)
+			app.report.recordProject(p.ProjectID, p.Name, stepProjectCreated, statusPlanned, "")
+			successProjects[p.ProjectID] = p.Name
+			continue
+		}
+
+		_, err := app.projectManager.CreateProject(ctx, req)
 		if err != nil {
-			if strings.Contains(err.Error(), "already exists") {
+			if components.IsAlreadyExists(err) {
 				blog.Infof(err.Error())
+				// projects not created by this tool are never removed by rollback
+				app.markProject(p.ProjectID, p.Name, stepProjectExisted, "")
 				successProjects[p.ProjectID] = p.Name
 				continue
 			}
 			blog.Errorf("create project %s[%s] failed, %v", p.Name, p.ProjectID, err)
+			app.markProject(p.ProjectID, p.Name, stepProjectCreated, err.Error())
 			failedProjects[p.ProjectID] = p.Name
 			continue
 		}
+		app.markProject(p.ProjectID, p.Name, stepProjectCreated, "")
 		successProjects[p.ProjectID] = p.Name
 		blog.Infof("create project %s[%s] success", p.Name, p.ProjectID)
 	}
@@ -178,110 +421,224 @@ func (app *App) migrateProjects() error {
 	return nil
 }
 
-func (app *App) migrateClusters() ([]types.ClusterM, map[string]string, error) {
-	clusterCol := app.mongoClient.Database(mongoDBNameCluster).Collection(mongoDBCollectionNameCluster)
-	clusters := make([]types.Cluster, 0)
-	successClusters := make([]types.ClusterM, 0)
-	failedClusters := make([]types.ClusterM, 0)
-	changedClusters := make(map[string]string, 0)
+// migrateClusters migrate clusters into cluster manager, returns the migrated and the failed clusters
+func (app *App) migrateClusters(ctx context.Context, clusters []types.Cluster, snapshot *clusterSnapshot,
+	changedClusters *clusterIDMapping) ([]types.ClusterM, []types.ClusterM) {
+	results := &clusterResults{}
+	app.parallelize(ctx, len(clusters), func(ctx context.Context, i int) {
+		app.migrateCluster(ctx, clusters[i], snapshot, results, changedClusters)
+	})
+	if ctx.Err() != nil {
+		return nil, nil
+	}
 
-	if len(app.op.ProjectIDs) != 0 {
-		app.sqlClient.Model(&types.Cluster{}).Where("project_id IN (?) AND status = ?", app.op.ProjectIDs, "normal").Find(&clusters)
-	} else {
-		app.sqlClient.Model(&types.Cluster{}).Where("status = ?", "normal").Find(&clusters)
+	app.processDupClusters(ctx, snapshot, results, changedClusters)
+	blog.Infof("migrated %d clusters", len(results.success))
+	blog.Infof("%d clusters failed: %v", len(results.failed), clusterIDs(results.failed))
+
+	return results.success, results.failed
+}
+
+// migrateCluster migrate cluster in 1.18 into cluster manager and bcs cc, clusters whose clusterID
+// is taken are collected as duplicated and processed later
+func (app *App) migrateCluster(ctx context.Context, c types.Cluster, snapshot *clusterSnapshot,
+	results *clusterResults, changedClusters *clusterIDMapping) {
+	override := app.override(c.ClusterID)
+	if override.Skip {
+		blog.Infof("cluster %s[%s] is skipped by overrides", c.Name, c.ClusterID)
+		app.report.recordCluster(c.ClusterID, "", c.ProjectID, c.Name, phaseOverridden, statusSkipped, "")
+		return
+	}
+	businessID := override.BusinessID
+	if businessID == "" {
+		businessID = app.getClusterBusinessID(ctx, c.ProjectID)
 	}
 
-	blog.Infof("got %d clusters from database", len(clusters))
+	now := time.Now()
+	clusterM := types.ClusterM{
+		CreateTime:             now.Format("2006-01-02T15:04:05Z"),
+		UpdateTime:             now.Format("2006-01-02T15:04:05Z"),
+		ClusterID:              c.ClusterID,
+		ClusterName:            c.Name,
+		Provider:               orDefault(override.Provider, "bluekingCloud"),
+		Region:                 orDefault(override.Region, "default"),
+		ProjectID:              c.ProjectID,
+		BusinessID:             businessID,
+		Environment:            orDefault(override.Environment, c.Environment),
+		EngineType:             c.Type,
+		ClusterType:            "single",
+		Creator:                c.Creator,
+		ManageType:             "INDEPENDENT_CLUSTER",
+		Master:                 map[string]*types.Node{},
+		ClusterBasicSettings:   &types.ClusterBasicSetting{},
+		ClusterAdvanceSettings: &types.ClusterAdvanceSetting{},
+		Status:                 "RUNNING",
+		NetworkType:            "overlay",
+		Description:            c.Description,
+	}
 
-	dupClusters := make([]types.ClusterM, 0)
-	for _, c := range clusters {
-		now := time.Now()
-		clusterM := types.ClusterM{
-			CreateTime:             now.Format("2006-01-02T15:04:05Z"),
-			UpdateTime:             now.Format("2006-01-02T15:04:05Z"),
-			ClusterID:              c.ClusterID,
-			ClusterName:            c.Name,
-			Provider:               "bluekingCloud",
-			Region:                 "default",
-			ProjectID:              c.ProjectID,
-			BusinessID:             app.getClusterBusinessID(c.ProjectID),
-			Environment:            c.Environment,
-			EngineType:             c.Type,
-			ClusterType:            "single",
-			Creator:                c.Creator,
-			ManageType:             "INDEPENDENT_CLUSTER",
-			Master:                 map[string]*types.Node{},
-			ClusterBasicSettings:   &types.ClusterBasicSetting{},
-			ClusterAdvanceSettings: &types.ClusterAdvanceSetting{},
-			Status:                 "RUNNING",
-			NetworkType:            "overlay",
-			Description:            c.Description,
-		}
-
-		existClustersMongo := make([]types.ClusterM, 0)
-		cursor, err := clusterCol.Find(context.Background(), bson.M{})
+	// resume from the step where the last run stopped
+	if record := app.journal.getCluster(c.ClusterID); record != nil {
+		resumed, err := app.resumeCluster(ctx, c, record, snapshot, changedClusters)
 		if err != nil {
-			return successClusters, nil, err
+			blog.Errorf("resume cluster %s[%s] failed, %v", c.Name, c.ClusterID, err)
+			app.report.recordCluster(c.ClusterID, record.ClusterID, c.ProjectID, c.Name, phaseResume,
+				statusFailed, err.Error())
+			results.addFailed(clusterM)
+			return
+		}
+		if resumed != nil {
+			app.report.recordCluster(c.ClusterID, resumed.ClusterID, c.ProjectID, c.Name, phaseResume,
+				statusSuccess, "")
+			results.addSuccess(*resumed)
+			return
 		}
+	}
 
-		if err = cursor.All(context.Background(), &existClustersMongo); err != nil {
-			return successClusters, nil, err
+	exist := false
+	// 重复执行可能存在已经迁移的情况，clusterID可能已变更
+	if cm := snapshot.findImported(c); cm != nil {
+		if cm.ClusterID != c.ClusterID {
+			changedClusters.set(cm.ClusterID, c.ClusterID)
+			blog.Infof("clusterID of cluster[%s] changed from %s to %s", c.Name, c.ClusterID, cm.ClusterID)
 		}
-		cursor.Close(context.Background())
+		clusterM.ClusterID = cm.ClusterID
+		results.addSuccess(clusterM)
+		exist = true
+	}
 
-		exist := false
-		// 重复执行可能存在clusterID变更而且已经迁移的情况
-		for _, cm := range existClustersMongo {
-			if cm.ProjectID == c.ProjectID && cm.ClusterName == c.Name &&
-				cm.Description == c.Description && c.ClusterID != cm.ClusterID {
-				changedClusters[cm.ClusterID] = c.ClusterID
-				blog.Infof("clusterID of cluster[%s] changed from %s to %s", c.Name, c.ClusterID, cm.ClusterID)
-				clusterM.ClusterID = cm.ClusterID
-				successClusters = append(successClusters, clusterM)
-				exist = true
-				break
+	if !app.op.MigrateClusterData {
+		return
+	}
+	if exist {
+		blog.Infof("cluster %s[%s] imported already, skipping...",
+			clusterM.ClusterName, clusterM.ClusterID)
+		app.report.recordCluster(c.ClusterID, clusterM.ClusterID, c.ProjectID, c.Name, stepClusterInserted,
+			statusSkipped, "")
+		return
+	}
+	if override.ClusterID != "" {
+		if override.ClusterID != c.ClusterID {
+			blog.Infof("clusterID of cluster[%s] changed from %s to %s by overrides", c.Name, c.ClusterID,
+				override.ClusterID)
+			changedClusters.set(override.ClusterID, c.ClusterID)
+			clusterM.ClusterID = override.ClusterID
+		}
+		if cm := snapshot.get(override.ClusterID); cm != nil {
+			if cm.ProjectID == c.ProjectID && cm.ClusterName == c.Name {
+				blog.Infof("cluster %s[%s] imported already, skipping...", c.Name, cm.ClusterID)
+				app.report.recordCluster(c.ClusterID, cm.ClusterID, c.ProjectID, c.Name, stepClusterInserted,
+					statusSkipped, "")
+				results.addSuccess(*cm)
+				return
 			}
+			err := fmt.Errorf("cluster_id %s in overrides is used by another cluster", override.ClusterID)
+			app.markCluster(c.ClusterID, override.ClusterID, c.ProjectID, c.Name, stepClusterIDAllocated,
+				err.Error())
+			results.addFailed(clusterM)
+			return
 		}
+	}
+	masters, err := getMasterNodes(ctx, app.op, clusterM, c.ClusterID)
+	if err != nil {
+		blog.Errorf("get master nodes for cluster %s[%s] failed, %v",
+			clusterM.ClusterName, clusterM.ClusterID, err)
+		app.report.recordCluster(c.ClusterID, clusterM.ClusterID, c.ProjectID, c.Name, phaseMasterNodes,
+			statusFailed, err.Error())
+		results.addFailed(clusterM)
+		return
+	}
+	clusterM = addClusterInfo(masters, clusterM)
+	if app.op.DryRun {
+		if snapshot.get(clusterM.ClusterID) != nil && override.ClusterID == "" {
+			results.addDup(clusterM)
+			return
+		}
+		snapshot.add(clusterM)
+		app.planCluster(c.ClusterID, clusterM)
+		results.addSuccess(clusterM)
+		return
+	}
 
-		if app.op.MigrateClusterData {
-			if exist {
-				blog.Infof("cluster %s[%s] imported already, skipping...",
-					clusterM.ClusterName, clusterM.ClusterID)
-				continue
-			}
-			masters, err := getMasterNodes(app.op, clusterM, changedClusters)
-			if err != nil {
-				blog.Errorf("get master nodes for cluster %s[%s] failed, %v",
-					clusterM.ClusterName, clusterM.ClusterID, err)
-				continue
-			}
-			clusterM = addClusterInfo(masters, clusterM)
-			_, err = clusterCol.InsertOne(context.Background(), clusterM)
-			if err != nil {
-				if strings.Contains(err.Error(), "duplicate key") {
-					dupClusters = append(dupClusters, clusterM)
-					continue
-				}
+	app.markCluster(c.ClusterID, clusterM.ClusterID, c.ProjectID, c.Name, stepClusterIDAllocated, "")
+	err = app.insertClusterM(ctx, clusterM)
+	if err != nil {
+		// clusterIDs forced by overrides are never reallocated
+		if isClusterDuplicated(err) && override.ClusterID == "" {
+			results.addDup(clusterM)
+			return
+		}
 
-				failedClusters = append(failedClusters, clusterM)
-				blog.Errorf("migrate cluster %s[%s] failed, %v", clusterM.ClusterID, clusterM.ClusterName, err)
-				continue
-			}
+		app.markCluster(c.ClusterID, clusterM.ClusterID, c.ProjectID, c.Name, stepClusterInserted,
+			err.Error())
+		results.addFailed(clusterM)
+		blog.Errorf("migrate cluster %s[%s] failed, %v", clusterM.ClusterID, clusterM.ClusterName, err)
+		return
+	}
+	snapshot.add(clusterM)
+	app.markCluster(c.ClusterID, clusterM.ClusterID, c.ProjectID, c.Name, stepClusterInserted, "")
 
-			err = createClusterInCc(app.op, clusterM)
-			if err != nil {
-				failedClusters = append(failedClusters, clusterM)
-				continue
-			}
-			successClusters = append(successClusters, clusterM)
+	err = app.createClusterInCc(ctx, c.ClusterID, clusterM)
+	if err != nil {
+		results.addFailed(clusterM)
+		return
+	}
+	results.addSuccess(clusterM)
+}
+
+func clusterIDsOf(errs map[string]string) []string {
+	ids := make([]string, 0, len(errs))
+	for id := range errs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func clusterIDs(clusters []types.ClusterM) []string {
+	ids := make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		ids = append(ids, c.ClusterID)
+	}
+	return ids
+}
+
+// resumeCluster continue migrating the cluster recorded in journal, nil cluster is returned if it was not imported
+func (app *App) resumeCluster(ctx context.Context, c types.Cluster, record *clusterRecord,
+	snapshot *clusterSnapshot, changedClusters *clusterIDMapping) (*types.ClusterM, error) {
+	if record.ClusterID == "" {
+		return nil, nil
+	}
+
+	imported := snapshot.get(record.ClusterID)
+	if imported != nil && (imported.ProjectID != c.ProjectID || imported.ClusterName != c.Name) {
+		imported = nil
+	}
+	if imported == nil {
+		if _, ok := record.Steps[stepClusterInserted]; ok {
+			blog.Warnf("cluster %s[%s] recorded as %s in journal but not found in cluster manager, migrating again",
+				c.Name, c.ClusterID, record.ClusterID)
+			app.journal.resetCluster(c.ClusterID)
 		}
+		return nil, nil
+	}
+
+	if record.ClusterID != c.ClusterID {
+		changedClusters.set(record.ClusterID, c.ClusterID)
 	}
+	if _, ok := record.Steps[stepClusterInserted]; !ok {
+		// the last run stopped right after inserting the cluster
+		app.markCluster(c.ClusterID, record.ClusterID, c.ProjectID, c.Name, stepClusterInserted, "")
+	}
+	blog.Infof("resume cluster %s[%s] as %s from journal", c.Name, c.ClusterID, record.ClusterID)
 
-	successClusters, failedClusters = app.processDupClusters(dupClusters, successClusters, failedClusters, changedClusters)
-	blog.Infof("migrated %d clusters", len(successClusters))
-	blog.Infof("%d clusters failed: %v", len(failedClusters), failedClusters)
+	if app.op.MigrateClusterData && !app.op.DryRun {
+		if err := app.createClusterInCc(ctx, c.ClusterID, *imported); err != nil {
+			return nil, err
+		}
+	}
 
-	return successClusters, changedClusters, nil
+	return imported, nil
 }
 
 func addClusterInfo(masters []*corev1.Node, cluster types.ClusterM) types.ClusterM {
@@ -331,10 +688,18 @@ func addClusterInfo(masters []*corev1.Node, cluster types.ClusterM) types.Cluste
 	return cluster
 }
 
-func createClusterInCc(op *options.UpgradeOption, cluster types.ClusterM) error {
+// createClusterInCc sync cluster to bcs cc and update its status, steps done in journal are skipped
+func (app *App) createClusterInCc(ctx context.Context, originClusterID string, cluster types.ClusterM) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if app.journal.clusterDone(originClusterID, stepClusterStatus) {
+		blog.Infof("cluster %s[%s] synced to bcs cc already, skipping...", cluster.ClusterName, cluster.ClusterID)
+		return nil
+	}
 	blog.Infof("sync cluster %s[%s] to bcs cc", cluster.ClusterName, cluster.ClusterID)
 
-	resp, err := components.GetAccessToken(op.BCSCc, op.Debug)
+	resp, err := app.bcsCc.GetAccessToken(ctx)
 	if err != nil {
 		blog.Errorf("get access token failed")
 		return err
@@ -348,106 +713,105 @@ func createClusterInCc(op *options.UpgradeOption, cluster types.ClusterM) error
 		})
 	}
 
-	clusterNum, _ := strconv.Atoi(strings.TrimPrefix(cluster.ClusterID, "BCS-K8S-"))
-	_, err = components.SyncClusterToCc(op.BCSCc.Addr, cluster.ProjectID, resp.Data.AccessToken, op.Debug,
-		&components.SyncClusterReq{
-			ProjectID:   cluster.ProjectID,
-			ClusterID:   cluster.ClusterID,
-			ClusterNum:  clusterNum,
-			Name:        cluster.ClusterName,
-			Creator:     cluster.Creator,
-			Description: cluster.Description,
-			Type:        "k8s",
-			Environment: "prod",
-			AreaID:      1,
-			Status:      cluster.Status,
-			MasterIPs:   masterData,
-		})
-	if err != nil {
-		blog.Errorf("sync cluster %s[%s] to bcs cc failed, %v", cluster.ClusterName, cluster.ClusterID, err)
-		return err
+	if !app.journal.clusterDone(originClusterID, stepClusterSyncedToCc) {
+		clusterNum, _ := strconv.Atoi(strings.TrimPrefix(cluster.ClusterID, "BCS-K8S-"))
+		_, err = app.bcsCc.SyncClusterToCc(ctx, cluster.ProjectID, resp.Data.AccessToken,
+			&components.SyncClusterReq{
+				ProjectID:   cluster.ProjectID,
+				ClusterID:   cluster.ClusterID,
+				ClusterNum:  clusterNum,
+				Name:        cluster.ClusterName,
+				Creator:     cluster.Creator,
+				Description: cluster.Description,
+				Type:        "k8s",
+				Environment: orDefault(cluster.Environment, "prod"),
+				AreaID:      1,
+				Status:      cluster.Status,
+				MasterIPs:   masterData,
+			})
+		if err != nil {
+			blog.Errorf("sync cluster %s[%s] to bcs cc failed, %v", cluster.ClusterName, cluster.ClusterID, err)
+			app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+				stepClusterSyncedToCc, err.Error())
+			return err
+		}
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepClusterSyncedToCc, "")
 	}
 
-	err = components.UpdateCluster(op.BCSCc.Addr, cluster.ProjectID, cluster.ClusterID, resp.Data.AccessToken, op.Debug,
+	err = app.bcsCc.UpdateCluster(ctx, cluster.ProjectID, cluster.ClusterID, resp.Data.AccessToken,
 		&components.ClusterParamsRequest{
 			Status: "normal",
 		})
 	if err != nil {
 		blog.Errorf("update %s[%s] status in bcs cc failed, %v", cluster.ClusterName, cluster.ClusterID, err)
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepClusterStatus, err.Error())
 		return err
 	}
+	app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+		stepClusterStatus, "")
 
 	return nil
 }
 
-func (app *App) processDupClusters(dupClusters, success, failed []types.ClusterM, changedClusters map[string]string) (
-	[]types.ClusterM, []types.ClusterM) {
-	clusterCol := app.mongoClient.Database(mongoDBNameCluster).Collection(mongoDBCollectionNameCluster)
-	for _, c := range dupClusters {
-		clusterNum, err := app.generateClusterID()
+// processDupClusters give duplicated clusters new clusterIDs one by one, so that no clusterID is allocated twice
+func (app *App) processDupClusters(ctx context.Context, snapshot *clusterSnapshot, results *clusterResults,
+	changedClusters *clusterIDMapping) {
+	for _, c := range results.dup {
+		if ctx.Err() != nil {
+			blog.Errorf("processDupClusters %s[%s] cancelled, %v", c.ClusterName, c.ClusterID, ctx.Err())
+			results.addFailed(c)
+			continue
+		}
+		clusterNum, err := app.allocateClusterNum(ctx, snapshot)
 		if err != nil {
-			blog.Errorf("processDupClusters generateClusterID failed, %v", err)
-			failed = append(failed, c)
+			blog.Errorf("processDupClusters %s[%s] failed, %v", c.ClusterName, c.ClusterID, err)
+			results.addFailed(c)
 			continue
 		}
 		newClusterID := fmt.Sprintf("BCS-K8S-%d", clusterNum)
+		originClusterID := c.ClusterID
 		blog.Infof("clusterID of cluster[%s] changed from %s to %s", c.ClusterName, c.ClusterID, newClusterID)
-		changedClusters[newClusterID] = c.ClusterID
+		changedClusters.set(newClusterID, originClusterID)
 		c.ClusterID = newClusterID
 
+		if app.op.MigrateClusterData && app.op.DryRun {
+			app.recordChange("clusterID of cluster %s[%s] conflicts, will be changed to %s",
+				c.ClusterName, originClusterID, newClusterID)
+			snapshot.add(c)
+			app.planCluster(originClusterID, c)
+			results.addSuccess(c)
+			continue
+		}
+
 		if app.op.MigrateClusterData {
-			_, err = clusterCol.InsertOne(context.Background(), c)
+			app.markCluster(originClusterID, c.ClusterID, c.ProjectID, c.ClusterName, stepClusterIDAllocated, "")
+			err = app.insertClusterM(ctx, c)
 			if err != nil {
 				blog.Errorf("processDupClusters %s[%s] failed, %v", c.ClusterName, c.ClusterID, err)
-				failed = append(failed, c)
+				app.markCluster(originClusterID, c.ClusterID, c.ProjectID, c.ClusterName, stepClusterInserted,
+					err.Error())
+				results.addFailed(c)
 				continue
 			}
-			err = createClusterInCc(app.op, c)
+			snapshot.add(c)
+			app.markCluster(originClusterID, c.ClusterID, c.ProjectID, c.ClusterName, stepClusterInserted, "")
+			err = app.createClusterInCc(ctx, originClusterID, c)
 			if err != nil {
-				failed = append(failed, c)
+				results.addFailed(c)
 				continue
 			}
-			success = append(success, c)
+			results.addSuccess(c)
 		}
 	}
-	return success, failed
 }
 
-func (app *App) generateClusterID() (int, error) {
-	clusterCol := app.mongoClient.Database(mongoDBNameCluster).Collection(mongoDBCollectionNameCluster)
-	cursor, err := clusterCol.Find(context.Background(), bson.M{})
-	if err != nil {
-		return 0, err
-	}
-	defer cursor.Close(context.Background())
-
-	var clusters []types.ClusterM
-	if err = cursor.All(context.Background(), &clusters); err != nil {
-		return 0, err
-	}
-
-	clusterNumIDs := make([]int, 0)
-	for i := range clusters {
-		clusterStrs := strings.Split(clusters[i].ClusterID, "-")
-		if len(clusterStrs) != 3 {
-			continue
-		}
-
-		id, _ := strconv.Atoi(clusterStrs[2])
-		clusterNumIDs = append(clusterNumIDs, id)
-	}
-	sort.Ints(clusterNumIDs)
-
-	if len(clusterNumIDs) == 0 {
-		return 1, nil
-	}
-
-	return clusterNumIDs[len(clusterNumIDs)-1] + 1, nil
-}
-
-func getMasterNodes(op *options.UpgradeOption, cluster types.ClusterM, changeClusters map[string]string) ([]*corev1.Node, error) {
+// getMasterNodes master nodes of cluster through the old bcs api, originClusterID is the clusterID in 1.18
+func getMasterNodes(ctx context.Context, op *options.UpgradeOption, cluster types.ClusterM,
+	originClusterID string) ([]*corev1.Node, error) {
 	// create clientset from bcs-api
-	clientset, err := generateClientset(op, cluster, changeClusters)
+	clientset, err := generateClientset(ctx, op, cluster, originClusterID)
 	if err != nil {
 		return nil, err
 	}
@@ -459,7 +823,7 @@ func getMasterNodes(op *options.UpgradeOption, cluster types.ClusterM, changeClu
 	cluster.ClusterBasicSettings.Version = version.GitVersion
 
 	configmap, err := clientset.CoreV1().ConfigMaps("kube-system").
-		Get(context.Background(), "kube-proxy", metav1.GetOptions{})
+		Get(ctx, "kube-proxy", metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -470,7 +834,7 @@ func getMasterNodes(op *options.UpgradeOption, cluster types.ClusterM, changeClu
 	}
 
 	masters := make([]*corev1.Node, 0)
-	nodeList, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	nodeList, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -485,20 +849,56 @@ func getMasterNodes(op *options.UpgradeOption, cluster types.ClusterM, changeClu
 	return masters, nil
 }
 
-func deployKubeAgent(op *options.UpgradeOption, cluster types.ClusterM, changeClusters map[string]string) error {
+func (app *App) deployKubeAgent(ctx context.Context, cluster types.ClusterM, changeClusters *clusterIDMapping) error {
+	originClusterID := changeClusters.origin(cluster.ClusterID)
+	op := app.clusterOption(originClusterID)
 	blog.Infof("deploying new kube agent for %s[%s]", cluster.ClusterName, cluster.ClusterID)
 	// create clientset from bcs-api
-	clientset, err := generateClientset(op, cluster, changeClusters)
+	config, err := generateRestConfig(ctx, op, cluster, originClusterID)
 	if err != nil {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepAgentDeployed, err.Error())
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepAgentDeployed, err.Error())
 		return err
 	}
 
-	err = createKubeAgentSecret(op, clientset)
+	secret, err := getCertSecret(ctx, op, op.KubeAgent.Namespace)
 	if err != nil {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepAgentDeployed, err.Error())
 		return err
 	}
 
-	err = createKubeAgent(op, clientset, cluster.ClusterID)
+	// secret and deployment are always applied, so that a rerun picks up new certs and image
+	var deployments []*v1.Deployment
+	if kubeAgentByHelm(op) {
+		deployments, err = app.applyKubeAgentRelease(ctx, op, config, clientset, cluster, originClusterID, secret)
+	} else {
+		deployments, err = app.applyKubeAgentManifest(ctx, op, clientset, cluster, originClusterID, secret)
+	}
+	if err != nil || op.DryRun {
+		return err
+	}
+
+	// the cluster is migrated only when it is reachable through the new kube agent
+	for _, deployment := range deployments {
+		if err = waitForRollout(ctx, op, clientset, deployment.Namespace, deployment.Name); err != nil {
+			break
+		}
+	}
+	app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+		stepAgentReady, errString(err))
+	if err != nil {
+		return err
+	}
+	err = waitForRegistration(ctx, op, cluster.ClusterID)
+	app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+		stepAgentRegistered, errString(err))
 	if err != nil {
 		return err
 	}
@@ -508,22 +908,96 @@ func deployKubeAgent(op *options.UpgradeOption, cluster types.ClusterM, changeCl
 	return nil
 }
 
-func generateClientset(op *options.UpgradeOption, cluster types.ClusterM, changeClusters map[string]string) (
+// applyKubeAgentManifest create or update objects in the manifest at yaml_path in manifestOrder, then the cert
+// secret and the bcs kube agent Deployment
+func (app *App) applyKubeAgentManifest(ctx context.Context, op *options.UpgradeOption,
+	clientset *kubernetes.Clientset, cluster types.ClusterM, originClusterID string,
+	secret *corev1.Secret) ([]*v1.Deployment, error) {
+	m, err := renderKubeAgent(ctx, op, clientset, cluster, originClusterID)
+	if err != nil {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepAgentDeployed, err.Error())
+		return nil, err
+	}
+
+	for _, obj := range m.objects {
+		result, diff, err := applyObject(ctx, clientset, obj, app.op.DryRun)
+		app.recordApply(cluster, originClusterID, stepAgentObjects, describeObject(obj), result, diff, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = app.applyComponent(ctx, clientset, cluster, originClusterID, secret, m.deployment,
+		stepSecretCreated, stepAgentDeployed)
+	if err != nil {
+		return nil, err
+	}
+	return []*v1.Deployment{m.deployment}, nil
+}
+
+// kubeAgentDeployments Deployments of the new bcs kube agent found in cluster
+func kubeAgentDeployments(ctx context.Context, op *options.UpgradeOption, config *rest.Config,
+	clientset kubernetes.Interface, vars *manifestVars) ([]*v1.Deployment, error) {
+	var rendered []*v1.Deployment
+	if kubeAgentByHelm(op) {
+		released, err := getReleaseDeployments(config, op.KubeAgent.Namespace, kubeAgentRelease(op))
+		if err != nil {
+			return nil, err
+		}
+		rendered = released
+	} else {
+		deployment, err := loadKubeAgentDeployment(op, vars)
+		if err != nil {
+			return nil, err
+		}
+		deployment.Namespace = op.KubeAgent.Namespace
+		rendered = []*v1.Deployment{deployment}
+	}
+
+	deployments := make([]*v1.Deployment, 0, len(rendered))
+	for _, r := range rendered {
+		deployment, err := clientset.AppsV1().Deployments(r.Namespace).Get(ctx, r.Name, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		deployments = append(deployments, deployment)
+	}
+	return deployments, nil
+}
+
+func generateClientset(ctx context.Context, op *options.UpgradeOption, cluster types.ClusterM, originClusterID string) (
 	*kubernetes.Clientset, error) {
-	host := op.BCSApi.Addr
-	token := op.BCSApi.Token
-	orgClusterID := cluster.ClusterID
-	if value, ok := changeClusters[cluster.ClusterID]; ok {
-		orgClusterID = value
+	config, err := generateRestConfig(ctx, op, cluster, originClusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	// create clientset from bcs-api
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
-	id, err := components.GetClusterIdentifier(host, token, cluster.ProjectID, orgClusterID, op.Debug)
+	return clientset, nil
+}
+
+// generateRestConfig rest config of the old bcs api tunnel to cluster, originClusterID is its clusterID in 1.18
+func generateRestConfig(ctx context.Context, op *options.UpgradeOption, cluster types.ClusterM,
+	orgClusterID string) (*rest.Config, error) {
+	host := op.BCSApi.Addr
+
+	bcsAPI := newBCSApi(op)
+	id, err := bcsAPI.GetClusterIdentifier(ctx, cluster.ProjectID, orgClusterID)
 	if err != nil {
 		blog.Errorf("get cluster %s identifier failed, %v", orgClusterID, err)
 		return nil, err
 	}
 
-	resp, err := components.GetClusterCredential(host, token, id.ID, op.Debug)
+	resp, err := bcsAPI.GetClusterCredential(ctx, id.ID)
 	if err != nil {
 		blog.Errorf("get cluster %s credential failed, %v", orgClusterID, err)
 		return nil, err
@@ -538,194 +1012,146 @@ func generateClientset(op *options.UpgradeOption, cluster types.ClusterM, change
 		BearerToken: resp.UserToken,
 	}
 
-	// create clientset from bcs-api
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
-	return clientset, nil
+	return config, nil
 }
 
-func createKubeAgentSecret(op *options.UpgradeOption, clientset *kubernetes.Clientset) error {
+// getKubeAgentSecret get bcs cert secret from blueking cluster for the new bcs kube agent
+func getCertSecret(ctx context.Context, op *options.UpgradeOption, namespace string) (*corev1.Secret, error) {
 	// construct k8s client config by bcs api gateway in new version
-	restConfig := &rest.Config{
-		Host:        op.BCSApiGateway.Addr + "/clusters/" + op.BKClusterID,
-		BearerToken: op.BCSApiGateway.Token,
-		TLSClientConfig: rest.TLSClientConfig{
-			Insecure: true,
-		},
-		QPS:   100,
-		Burst: 100,
-	}
-	client, err := kubernetes.NewForConfig(restConfig)
+	client, err := kubernetes.NewForConfig(bkClusterConfig(op))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// get secret from blueking cluster
-	secret, err := client.CoreV1().Secrets("bcs-system").
-		Get(context.Background(), op.BCSCertName, metav1.GetOptions{})
+	secret, err := client.CoreV1().Secrets(bcsSystemNamespace).
+		Get(ctx, op.BCSCertName, metav1.GetOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// create secret by old version bcs api
 	newSecret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      op.BCSCertName,
-			Namespace: op.KubeAgent.Namespace,
+			Namespace: namespace,
 		},
 		Immutable:  secret.Immutable,
 		Data:       secret.Data,
 		StringData: secret.StringData,
 		Type:       secret.Type,
 	}
-	_, err = clientset.CoreV1().Secrets(op.KubeAgent.Namespace).
-		Create(context.Background(), newSecret, metav1.CreateOptions{})
-	if err != nil {
-		return err
-	}
 
-	return nil
+	return newSecret, nil
 }
 
-func createKubeAgent(op *options.UpgradeOption, clientset *kubernetes.Clientset, clusterID string) error {
-	oldDeployment, err := clientset.AppsV1().Deployments(op.KubeAgent.Namespace).
-		Get(context.Background(), "bcs-kube-agent", metav1.GetOptions{})
+// renderKubeAgent render the manifest at yaml_path for cluster, address, cluster id, token, image and cert
+// secret are set unless the template already sets them, the Deployment uses the service account of the
+// old bcs kube agent unless it sets its own
+func renderKubeAgent(ctx context.Context, op *options.UpgradeOption, clientset *kubernetes.Clientset,
+	cluster types.ClusterM, originClusterID string) (*manifest, error) {
+	imageRepo, serviceAccount, err := oldImageRepo(ctx, op, clientset, cluster.ClusterID,
+		oldComponent{name: oldKubeAgentName, namespace: op.KubeAgent.Namespace}, op.KubeAgent.ImageRepo,
+		op.KubeAgent.ServiceAccount)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	index := strings.LastIndex(oldDeployment.Spec.Template.Spec.Containers[0].Image, "/")
-	imageRepo := oldDeployment.Spec.Template.Spec.Containers[0].Image[:index+1]
+	vars := newManifestVars(op, cluster, originClusterID)
+	vars.ImageRepo = imageRepo
+	if vars.GatewayHost == "" {
+		return nil, fmt.Errorf("invalid bcs api gateway address")
+	}
 
-	gAddr := strings.Split(op.BCSApiGateway.Addr, "//")
-	if len(gAddr) != 2 {
-		return fmt.Errorf("invalid bcs api gateway address")
+	m, err := loadManifest(op.KubeAgent.YamlPath, vars)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.renderObjects(op.KubeAgent.Namespace); err != nil {
+		return nil, err
+	}
+	deployment := m.deployment
+	deployment.Namespace = op.KubeAgent.Namespace
+	container := &deployment.Spec.Template.Spec.Containers[0]
+	setArg(container, "--bke-address", fmt.Sprintf("wss://%s", vars.GatewayHost))
+	setArg(container, "--cluster-id", cluster.ClusterID)
+	setEnv(container, "USER_TOKEN", op.BCSApiGateway.Token)
+	if container.Image == "" {
+		container.Image = vars.ImageRepo + op.KubeAgent.Image
+	}
+	if deployment.Spec.Template.Spec.ServiceAccountName == "" {
+		deployment.Spec.Template.Spec.ServiceAccountName = serviceAccount
+		deployment.Spec.Template.Spec.DeprecatedServiceAccount = serviceAccount
 	}
-	hostAliaas := []corev1.HostAlias{}
 	if op.BCSApiGateway.IP != "" {
-		hostAliaas = append(hostAliaas, corev1.HostAlias{
-			IP:        op.BCSApiGateway.IP,
-			Hostnames: []string{gAddr[1]},
-		})
+		setHostAlias(&deployment.Spec.Template.Spec, op.BCSApiGateway.IP, vars.GatewayHost)
+	}
+	for k := range deployment.Spec.Template.Spec.Volumes {
+		volume := &deployment.Spec.Template.Spec.Volumes[k]
+		if volume.Name == "bcs-certs" && volume.Secret != nil {
+			volume.Secret.SecretName = op.BCSCertName
+		}
+	}
+
+	return m, nil
+}
+
+// setArg set value of flag in container args, the flag is appended if it is not there
+func setArg(container *corev1.Container, flag, value string) {
+	for i := range container.Args {
+		if strings.HasPrefix(container.Args[i], flag+"=") {
+			container.Args[i] = flag + "=" + value
+			return
+		}
+	}
+	container.Args = append(container.Args, flag+"="+value)
+}
+
+// setHostAlias resolve hostname to ip in pod, aliases of hostname set before are replaced
+func setHostAlias(spec *corev1.PodSpec, ip, hostname string) {
+	aliases := make([]corev1.HostAlias, 0, len(spec.HostAliases)+1)
+	for _, alias := range spec.HostAliases {
+		hostnames := make([]string, 0, len(alias.Hostnames))
+		for _, h := range alias.Hostnames {
+			if h != hostname {
+				hostnames = append(hostnames, h)
+			}
+		}
+		if len(hostnames) > 0 {
+			alias.Hostnames = hostnames
+			aliases = append(aliases, alias)
+		}
+	}
+	spec.HostAliases = append(aliases, corev1.HostAlias{IP: ip, Hostnames: []string{hostname}})
+}
+
+// loadKubeAgentDeployment load the new bcs kube agent Deployment from the manifest at yaml_path
+func loadKubeAgentDeployment(op *options.UpgradeOption, vars *manifestVars) (*v1.Deployment, error) {
+	m, err := loadManifest(op.KubeAgent.YamlPath, vars)
+	if err != nil {
+		return nil, err
 	}
+	return m.deployment, nil
+}
 
+// loadDeployment load Deployment from yaml file
+func loadDeployment(path string) (*v1.Deployment, error) {
 	// 从文件中读取 YAML 内容
-	yamlFile, err := ioutil.ReadFile(op.KubeAgent.YamlPath)
+	yamlFile, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 将 YAML 转换为 Deployment 对象
 	deployment := &v1.Deployment{}
 	_, _, err = scheme.Codecs.UniversalDeserializer().Decode(yamlFile, nil, deployment)
 	if err != nil {
-		return err
-	}
-	deployment.Namespace = op.KubeAgent.Namespace
-	deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args,
-		fmt.Sprintf("--bke-address=wss://%s", gAddr[1]),
-		fmt.Sprintf("--cluster-id=%s", clusterID))
-	deployment.Spec.Template.Spec.Containers[0].Env = append(deployment.Spec.Template.Spec.Containers[0].Env,
-		corev1.EnvVar{
-			Name:  "USER_TOKEN",
-			Value: op.BCSApiGateway.Token,
-		})
-	deployment.Spec.Template.Spec.Containers[0].Image = imageRepo + op.KubeAgent.Image
-	deployment.Spec.Template.Spec.ServiceAccountName = oldDeployment.Spec.Template.Spec.ServiceAccountName
-	deployment.Spec.Template.Spec.DeprecatedServiceAccount = oldDeployment.Spec.Template.Spec.ServiceAccountName
-	deployment.Spec.Template.Spec.HostAliases = hostAliaas
-	for k := range deployment.Spec.Template.Spec.Volumes {
-		if deployment.Spec.Template.Spec.Volumes[k].Name == "bcs-certs" {
-			deployment.Spec.Template.Spec.Volumes[k].Secret.SecretName = op.BCSCertName
-		}
-	}
-
-	_, err = clientset.AppsV1().Deployments(op.KubeAgent.Namespace).
-		Create(context.Background(), deployment, metav1.CreateOptions{})
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return deployment, nil
 }
 
-//func deployKubeAgentByHelm(op *options.UpgradeOption, projectID, clusterID string) error {
-//	host := op.BCSApi.Addr
-//	token := op.BCSApi.Token
-//
-//	id, err := components.GetClusterIdentifier(host, token, projectID, clusterID)
-//	if err != nil {
-//		blog.Errorf("get cluster %s identifier failed, %v", clusterID, err)
-//		return err
-//	}
-//
-//	resp, err := components.GetClusterCredential(host, token, id.ID)
-//	if err != nil {
-//		blog.Errorf("get cluster %s credential failed, %v", clusterID, err)
-//		return err
-//	}
-//
-//	config := &rest.Config{
-//		Host: fmt.Sprintf("%s/tunnels/clusters/%s", host, id.Identifier),
-//		TLSClientConfig: rest.TLSClientConfig{
-//			CertData: []byte(base64.StdEncoding.EncodeToString([]byte(resp.CaCert))),
-//		},
-//		BearerToken: resp.UserToken,
-//	}
-//
-//	chart, err := loader.Load(op.KubeAgent.HelmPackagePath)
-//	if err != nil {
-//		blog.Errorf("load helm package failed, %v", err)
-//		return err
-//	}
-//
-//	imageInfo := strings.Split(op.KubeAgent.Image, ":")
-//	if len(imageInfo) != 2 {
-//		return fmt.Errorf("invalid bcs kube agent image")
-//	}
-//
-//	releaseName := fmt.Sprintf("bcs-kube-agent-%s", imageInfo[1])
-//	namespace := op.KubeAgent.Namespace
-//	actionConfig := new(action.Configuration)
-//	if err := actionConfig.Init(GetHelmConfig(config.Host, config.BearerToken, "", namespace),
-//		namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
-//		blog.Errorf("init helm config failed, %v", err)
-//		return err
-//	}
-//
-//	iCli := action.NewInstall(actionConfig)
-//	iCli.Namespace = namespace
-//	iCli.ReleaseName = releaseName
-//
-//	gAddr := strings.Split(op.BCSApiGateway.Addr, "//")
-//	if len(gAddr) != 2 {
-//		return fmt.Errorf("invalid bcs api gateway address")
-//	}
-//
-//	values := make(map[string]interface{}, 0)
-//	values["image.registry"] = ""
-//	values["image.repository"] = imageInfo[0]
-//	values["image.tag"] = imageInfo[1]
-//	values["args.BK_BCS_API"] = fmt.Sprintf("wss://%s", gAddr[1])
-//	values["args.BK_BCS_clusterId"] = clusterID
-//	values["args.BK_BCS_insecureSkipVerify"] = "true"
-//	values["args.BK_BCS_kubeAgentWSTunnel"] = "true"
-//	values["args.BK_BCS_websocketPath"] = "/bcsapi/v4/clustermanager/v1/websocket/connect"
-//	values["args.BK_BCS_APIToken"] = op.BCSApiGateway.Token
-//
-//	_, err = iCli.Run(chart, values)
-//	if err != nil {
-//		blog.Errorf("install helm package failed, %v", err)
-//		return err
-//	}
-//
-//	blog.Infof("install release %s/%s success", namespace, releaseName)
-//
-//	return nil
-//}
-
+// GetHelmConfig helm client config of the cluster tunnel at host
 func GetHelmConfig(host, userToken, context, namespace string) *genericclioptions.ConfigFlags {
 	cf := genericclioptions.NewConfigFlags(true)
 	insecure := true
@@ -737,13 +1163,149 @@ func GetHelmConfig(host, userToken, context, namespace string) *genericclioption
 	return cf
 }
 
-func (app *App) getClusterBusinessID(projectID string) string {
+func (app *App) listProjects(ctx context.Context) ([]types.Project, error) {
+	projects := make([]types.Project, 0)
+	err := app.readOnly(ctx, func(tx *gorm.DB) error {
+		return tx.Model(&types.Project{}).Scopes(app.projectSelectors).Find(&projects).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list projects from mysql failed, %v", err)
+	}
+	if !hasClusterSelectors(app.op) {
+		return projects, nil
+	}
+
+	// only projects with selected clusters
+	clusters, err := app.listClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool, 0)
+	for _, c := range clusters {
+		selected[c.ProjectID] = true
+	}
+	result := make([]types.Project, 0, len(selected))
+	for _, p := range projects {
+		if selected[p.ProjectID] {
+			result = append(result, p)
+		}
+	}
+	blog.Infof("%d of %d projects have selected clusters", len(result), len(projects))
+
+	return result, nil
+}
+
+// listClusters list clusters selected by project_ids and filter
+func (app *App) listClusters(ctx context.Context) ([]types.Cluster, error) {
+	var nameRegex *regexp.Regexp
+	if app.op.Filter.NameRegex != "" {
+		var err error
+		if nameRegex, err = regexp.Compile(app.op.Filter.NameRegex); err != nil {
+			return nil, fmt.Errorf("invalid filter.name_regex, %v", err)
+		}
+	}
+
+	clusters := make([]types.Cluster, 0)
+	err := app.readOnly(ctx, func(tx *gorm.DB) error {
+		query := tx.Model(&types.Cluster{}).Scopes(app.clusterSelectors)
+		if hasProjectSelectors(app.op) {
+			projectIDs := make([]string, 0)
+			err := tx.Model(&types.Project{}).Scopes(app.projectSelectors).Pluck("project_id", &projectIDs).Error
+			if err != nil {
+				return err
+			}
+			query = query.Where("project_id IN (?)", projectIDs)
+		}
+		return query.Find(&clusters).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list clusters from mysql failed, %v", err)
+	}
+	if nameRegex == nil {
+		return clusters, nil
+	}
+
+	result := make([]types.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		if nameRegex.MatchString(c.Name) {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// listMigratedClusters list the migrated clusters in cluster manager and the changed clusterIDs
+func (app *App) listMigratedClusters(ctx context.Context) ([]types.ClusterM, *clusterIDMapping, error) {
+	clusters, err := app.listClusters(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot, err := app.loadClusterSnapshot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	migrated := make([]types.ClusterM, 0)
+	changedClusters := newClusterIDMapping()
+	for _, c := range clusters {
+		cm := snapshot.get(c.ClusterID)
+		if cm != nil && cm.ProjectID != c.ProjectID {
+			cm = nil
+		}
+		if cm == nil {
+			cm = snapshot.findImported(c)
+			if cm != nil && cm.ClusterID != c.ClusterID {
+				changedClusters.set(cm.ClusterID, c.ClusterID)
+			}
+		}
+		if cm == nil {
+			blog.Warnf("cluster %s[%s] not migrated, skipping...", c.Name, c.ClusterID)
+			continue
+		}
+		migrated = append(migrated, *cm)
+	}
+
+	return migrated, changedClusters, nil
+}
+
+func (app *App) getClusterBusinessID(ctx context.Context, projectID string) string {
 	var project types.Project
-	app.sqlClient.Model(&types.Project{}).Where("project_id = (?)", projectID).Find(&project)
+	err := app.readOnly(ctx, func(tx *gorm.DB) error {
+		return tx.Model(&types.Project{}).Where("project_id = (?)", projectID).Find(&project).Error
+	})
+	if err != nil {
+		blog.Errorf("get business id of project %s failed, %v", projectID, err)
+	}
 
 	return strconv.Itoa(int(project.CCAppID))
 }
 
+func (app *App) initClients() error {
+	app.initAPIClients()
+
+	if app.sqlClient == nil {
+		if err := app.initMysqlClient(); err != nil {
+			return err
+		}
+	}
+
+	if app.store == nil {
+		if err := app.initMongoClient(); err != nil {
+			app.closeClients()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *App) closeClients() {
+	for i := len(app.closers) - 1; i >= 0; i-- {
+		app.closers[i]()
+	}
+	app.closers = nil
+}
+
 func (app *App) initMysqlClient() error {
 	blog.Infof("initializing mysql database")
 
@@ -760,7 +1322,19 @@ func (app *App) initMysqlClient() error {
 	db.DB().SetMaxIdleConns(20)
 	db.DB().SetMaxOpenConns(20)
 
+	// bk_bcs_cc of 1.18 is only read, check the schema instead of migrating it
+	if err = checkSourceSchema(db); err != nil {
+		db.Close()
+		return err
+	}
+
 	app.sqlClient = db
+	app.closers = append(app.closers, func() {
+		if err := db.Close(); err != nil {
+			blog.Errorf("disconnect mysql failed, %v", err)
+		}
+		app.sqlClient = nil
+	})
 
 	blog.Infof("init mysql database done")
 
@@ -787,7 +1361,13 @@ func (app *App) initMongoClient() error {
 		return err
 	}
 
-	app.mongoClient = client
+	app.store = &mongoStore{client: client}
+	app.closers = append(app.closers, func() {
+		if err := app.store.close(context.Background()); err != nil {
+			blog.Errorf("disconnect mongoDB failed, %v", err)
+		}
+		app.store = nil
+	})
 
 	blog.Infof("init mongoDB database done")
 
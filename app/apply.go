@@ -0,0 +1,353 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// results of applying an object
+const (
+	applyCreated   = "created"
+	applyUpdated   = "updated"
+	applyUnchanged = "unchanged"
+)
+
+// templateHashAnnotation annotation of Deployments holding hash of the pod template last applied
+const templateHashAnnotation = "bcs-upgradetool/template-hash"
+
+// applyComponent create or update the cert secret and Deployment of a new component in cluster,
+// objects already matching are left alone so that migrate can be rerun after certificate rotation
+// or version bump, results are recorded as secretStep and deployStep
+func (app *App) applyComponent(ctx context.Context, clientset kubernetes.Interface, cluster types.ClusterM,
+	originClusterID string, secret *corev1.Secret, deployment *appsv1.Deployment, secretStep, deployStep string) error {
+	result, diff, err := applySecret(ctx, clientset, secret, app.op.DryRun)
+	app.recordApply(cluster, originClusterID, secretStep, "secret "+secret.Namespace+"/"+secret.Name,
+		result, diff, err)
+	if err != nil {
+		return err
+	}
+
+	result, diff, err = applyDeployment(ctx, clientset, deployment, app.op.DryRun)
+	app.recordApply(cluster, originClusterID, deployStep, "deployment "+deployment.Namespace+"/"+deployment.Name,
+		result, diff, err)
+	return err
+}
+
+// recordApply record result of applying object as step, only objects created or updated by this run are marked
+// in journal so that rollback never removes objects existed before
+func (app *App) recordApply(cluster types.ClusterM, originClusterID, step, object, result string, diff []string,
+	err error) {
+	if err != nil {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName, step,
+			err.Error())
+		return
+	}
+	logApply(cluster, object, result, diff)
+	if app.op.DryRun {
+		if result != applyUnchanged {
+			app.recordChange("%s would be %s in cluster %s[%s]: %s", object, result,
+				cluster.ClusterName, cluster.ClusterID, strings.Join(diff, "; "))
+		}
+		app.report.recordCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			step, statusPlanned, "")
+		return
+	}
+	if result == applyUnchanged {
+		app.report.recordCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			step, statusUnchanged, "")
+		return
+	}
+	app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName, step, "")
+}
+
+func logApply(cluster types.ClusterM, object, result string, diff []string) {
+	blog.Infof("%s in cluster %s[%s] %s", object, cluster.ClusterName, cluster.ClusterID, result)
+	for _, line := range diff {
+		blog.Infof("  %s", line)
+	}
+}
+
+// applySecret create secret, or update its type and data if they differ, values of data are never in diff
+func applySecret(ctx context.Context, clientset kubernetes.Interface, secret *corev1.Secret,
+	dryRun bool) (string, []string, error) {
+	setManagedBy(&secret.ObjectMeta)
+	secrets := clientset.CoreV1().Secrets(secret.Namespace)
+	existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		diff := []string{fmt.Sprintf("+ data keys %v", dataKeys(secret.Data))}
+		if !dryRun {
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		}
+		return applyCreated, diff, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return adoptObject(existing, diffSecret(existing, secret), dryRun, func() error {
+		existing.Type = secret.Type
+		existing.Data = secret.Data
+		existing.StringData = secret.StringData
+		_, err := secrets.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// adoptObject update object if diff is not empty, the cert secret and Deployments are named by upgrade tool so
+// those without the managed-by label, e.g. created by its earlier versions, are labelled and updated as well
+func adoptObject(existing metav1.Object, diff []string, dryRun bool, update func() error) (string, []string,
+	error) {
+	if existing.GetLabels()[managedByLabel] != managedByUpgradeTool {
+		diff = append(diff, fmt.Sprintf("+ label %s=%s", managedByLabel, managedByUpgradeTool))
+		labels := existing.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string, 0)
+		}
+		labels[managedByLabel] = managedByUpgradeTool
+		existing.SetLabels(labels)
+	}
+	if len(diff) == 0 {
+		return applyUnchanged, nil, nil
+	}
+	if dryRun {
+		return applyUpdated, diff, nil
+	}
+	return applyUpdated, diff, update()
+}
+
+// setManagedBy label object as managed by upgrade tool
+func setManagedBy(obj *metav1.ObjectMeta) {
+	if obj.Labels == nil {
+		obj.Labels = make(map[string]string, 0)
+	}
+	obj.Labels[managedByLabel] = managedByUpgradeTool
+}
+
+func dataKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func diffSecret(existing, desired *corev1.Secret) []string {
+	diff := make([]string, 0)
+	if existing.Type != desired.Type {
+		diff = append(diff, fmt.Sprintf("~ type %s -> %s", existing.Type, desired.Type))
+	}
+	return append(diff, diffData(existing.Data, desired.Data)...)
+}
+
+// diffData keys of data added, removed or changed
+func diffData(existing, desired map[string][]byte) []string {
+	diff := make([]string, 0)
+	keys := dataKeys(desired)
+	for k := range existing {
+		if _, ok := desired[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		oldValue, inExisting := existing[k]
+		newValue, inDesired := desired[k]
+		switch {
+		case !inExisting:
+			diff = append(diff, fmt.Sprintf("+ data.%s", k))
+		case !inDesired:
+			diff = append(diff, fmt.Sprintf("- data.%s", k))
+		case string(oldValue) != string(newValue):
+			diff = append(diff, fmt.Sprintf("~ data.%s changed", k))
+		}
+	}
+	return diff
+}
+
+// applyDeployment create Deployment, or replace its whole pod template if the template differs from the one
+// last applied, which is recorded by hash in annotation templateHashAnnotation since fields defaulted by
+// apiserver can not be compared
+func applyDeployment(ctx context.Context, clientset kubernetes.Interface, deployment *appsv1.Deployment,
+	dryRun bool) (string, []string, error) {
+	hash, err := templateHash(&deployment.Spec.Template)
+	if err != nil {
+		return "", nil, err
+	}
+	setManagedBy(&deployment.ObjectMeta)
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string, 0)
+	}
+	deployment.Annotations[templateHashAnnotation] = hash
+
+	deployments := clientset.AppsV1().Deployments(deployment.Namespace)
+	existing, err := deployments.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		diff := make([]string, 0)
+		for _, c := range deployment.Spec.Template.Spec.Containers {
+			diff = append(diff, fmt.Sprintf("+ container %s image %s args %v", c.Name, c.Image, c.Args))
+		}
+		if !dryRun {
+			_, err = deployments.Create(ctx, deployment, metav1.CreateOptions{})
+		}
+		return applyCreated, diff, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	diff := diffPodSpec(&existing.Spec.Template.Spec, &deployment.Spec.Template.Spec)
+	if len(diff) == 0 && existing.Annotations[templateHashAnnotation] != hash {
+		diff = append(diff, "~ pod template")
+	}
+	return adoptObject(existing, diff, dryRun, func() error {
+		if existing.Annotations == nil {
+			existing.Annotations = make(map[string]string, 0)
+		}
+		existing.Annotations[templateHashAnnotation] = hash
+		existing.Spec.Template = deployment.Spec.Template
+		_, err := deployments.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// templateHash hash of pod template in json
+func templateHash(template *corev1.PodTemplateSpec) (string, error) {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+func diffPodSpec(existing, desired *corev1.PodSpec) []string {
+	diff := make([]string, 0)
+	existingContainers := make(map[string]*corev1.Container, 0)
+	for i := range existing.Containers {
+		existingContainers[existing.Containers[i].Name] = &existing.Containers[i]
+	}
+	for i := range desired.Containers {
+		d := &desired.Containers[i]
+		e, ok := existingContainers[d.Name]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("+ container %s", d.Name))
+			continue
+		}
+		delete(existingContainers, d.Name)
+		if e.Image != d.Image {
+			diff = append(diff, fmt.Sprintf("~ container %s image %s -> %s", d.Name, e.Image, d.Image))
+		}
+		if !reflect.DeepEqual(e.Args, d.Args) {
+			diff = append(diff, fmt.Sprintf("~ container %s args %v -> %v", d.Name, e.Args, d.Args))
+		}
+		diff = append(diff, diffEnv(d.Name, e.Env, d.Env)...)
+	}
+	for name := range existingContainers {
+		diff = append(diff, fmt.Sprintf("- container %s", name))
+	}
+
+	if existing.ServiceAccountName != desired.ServiceAccountName {
+		diff = append(diff, fmt.Sprintf("~ serviceAccountName %s -> %s", existing.ServiceAccountName,
+			desired.ServiceAccountName))
+	}
+	if !reflect.DeepEqual(hostAliases(existing.HostAliases), hostAliases(desired.HostAliases)) {
+		diff = append(diff, fmt.Sprintf("~ hostAliases %v -> %v", hostAliases(existing.HostAliases),
+			hostAliases(desired.HostAliases)))
+	}
+	if !reflect.DeepEqual(secretVolumes(existing.Volumes), secretVolumes(desired.Volumes)) {
+		diff = append(diff, fmt.Sprintf("~ secret volumes %v -> %v", secretVolumes(existing.Volumes),
+			secretVolumes(desired.Volumes)))
+	}
+	return diff
+}
+
+func diffEnv(container string, existing, desired []corev1.EnvVar) []string {
+	diff := make([]string, 0)
+	existingEnv := make(map[string]string, 0)
+	for _, e := range existing {
+		existingEnv[e.Name] = envValue(e)
+	}
+	for _, d := range desired {
+		value, ok := existingEnv[d.Name]
+		delete(existingEnv, d.Name)
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("+ container %s env %s=%s", container, d.Name, redactEnv(d.Name,
+				envValue(d))))
+		case value != envValue(d):
+			diff = append(diff, fmt.Sprintf("~ container %s env %s %s -> %s", container, d.Name,
+				redactEnv(d.Name, value), redactEnv(d.Name, envValue(d))))
+		}
+	}
+	names := make([]string, 0, len(existingEnv))
+	for name := range existingEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		diff = append(diff, fmt.Sprintf("- container %s env %s", container, name))
+	}
+	return diff
+}
+
+func envValue(e corev1.EnvVar) string {
+	if e.ValueFrom != nil {
+		return fmt.Sprintf("%+v", *e.ValueFrom)
+	}
+	return e.Value
+}
+
+// redactEnv hide value of env holding tokens or passwords
+func redactEnv(name, value string) string {
+	lower := strings.ToLower(name)
+	if strings.Contains(lower, "token") || strings.Contains(lower, "password") || strings.Contains(lower, "secret") {
+		return options.Redacted
+	}
+	return value
+}
+
+func hostAliases(aliases []corev1.HostAlias) []string {
+	result := make([]string, 0, len(aliases))
+	for _, a := range aliases {
+		result = append(result, a.IP+"="+strings.Join(a.Hostnames, ","))
+	}
+	return result
+}
+
+func secretVolumes(volumes []corev1.Volume) map[string]string {
+	result := make(map[string]string, 0)
+	for _, v := range volumes {
+		if v.Secret != nil {
+			result[v.Name] = v.Secret.SecretName
+		}
+	}
+	return result
+}
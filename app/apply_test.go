@@ -0,0 +1,177 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testSecret(data string, labels map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bcs-certs", Namespace: "bcs-nodes", Labels: labels},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"ca.crt": []byte(data)},
+	}
+}
+
+func testDeployment(image string, labels map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "bcs-kube-agent-v2", Namespace: "bcs-nodes", Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "agent", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+var managed = map[string]string{managedByLabel: managedByUpgradeTool}
+
+func TestApplySecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *corev1.Secret
+		desired  *corev1.Secret
+		result   string
+		diff     []string
+	}{
+		{"created", nil, testSecret("a", nil), applyCreated, []string{"+ data keys [ca.crt]"}},
+		{"unchanged", testSecret("a", managed), testSecret("a", nil), applyUnchanged, nil},
+		{"rotated", testSecret("a", managed), testSecret("b", nil), applyUpdated,
+			[]string{"~ data.ca.crt changed"}},
+		{"adopted", testSecret("a", nil), testSecret("b", nil), applyUpdated,
+			[]string{"~ data.ca.crt changed", "+ label " + managedByLabel + "=" + managedByUpgradeTool}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tt.existing != nil {
+				clientset = fake.NewSimpleClientset(tt.existing)
+			}
+			result, diff, err := applySecret(context.Background(), clientset, tt.desired, false)
+			if err != nil {
+				t.Fatalf("apply failed, %v", err)
+			}
+			if result != tt.result || !reflect.DeepEqual(diff, tt.diff) {
+				t.Errorf("got %s %v, want %s %v", result, diff, tt.result, tt.diff)
+			}
+			got, err := clientset.CoreV1().Secrets("bcs-nodes").Get(context.Background(), "bcs-certs",
+				metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Data["ca.crt"]) != string(tt.desired.Data["ca.crt"]) ||
+				got.Labels[managedByLabel] != managedByUpgradeTool {
+				t.Errorf("secret not applied: %+v", got)
+			}
+		})
+	}
+}
+
+func TestApplyDeployment(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(testDeployment("bcs-kube-agent:v1", nil))
+	get := func() *appsv1.Deployment {
+		d, err := clientset.AppsV1().Deployments("bcs-nodes").Get(ctx, "bcs-kube-agent-v2", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// created by earlier versions without label, it is adopted
+	result, _, err := applyDeployment(ctx, clientset, testDeployment("bcs-kube-agent:v1", nil), false)
+	if err != nil || result != applyUpdated {
+		t.Fatalf("adopt: got %s %v, want %s", result, err, applyUpdated)
+	}
+	if get().Labels[managedByLabel] != managedByUpgradeTool {
+		t.Error("deployment not labelled")
+	}
+
+	result, diff, err := applyDeployment(ctx, clientset, testDeployment("bcs-kube-agent:v1", nil), false)
+	if err != nil || result != applyUnchanged || len(diff) != 0 {
+		t.Fatalf("rerun: got %s %v %v, want %s", result, diff, err, applyUnchanged)
+	}
+
+	// fields outside containers are compared through the template hash and replaced as a whole
+	desired := testDeployment("bcs-kube-agent:v1", nil)
+	desired.Spec.Template.Spec.NodeSelector = map[string]string{"role": "master"}
+	desired.Spec.Template.Labels = map[string]string{"app": "bcs-kube-agent"}
+	result, diff, err = applyDeployment(ctx, clientset, desired, false)
+	if err != nil || result != applyUpdated || !reflect.DeepEqual(diff, []string{"~ pod template"}) {
+		t.Fatalf("template change: got %s %v %v", result, diff, err)
+	}
+	if d := get(); d.Spec.Template.Spec.NodeSelector["role"] != "master" ||
+		d.Spec.Template.Labels["app"] != "bcs-kube-agent" {
+		t.Errorf("template not replaced: %+v", d.Spec.Template)
+	}
+
+	result, diff, err = applyDeployment(ctx, clientset, testDeployment("bcs-kube-agent:v2", nil), true)
+	if err != nil || result != applyUpdated ||
+		!reflect.DeepEqual(diff, []string{"~ container agent image bcs-kube-agent:v1 -> bcs-kube-agent:v2"}) {
+		t.Fatalf("dry run: got %s %v %v", result, diff, err)
+	}
+	if get().Spec.Template.Spec.Containers[0].Image != "bcs-kube-agent:v1" {
+		t.Error("dry run changed deployment")
+	}
+}
+
+func TestDiffPodSpec(t *testing.T) {
+	existing := &corev1.PodSpec{
+		ServiceAccountName: "bcs-kube-agent",
+		Containers: []corev1.Container{
+			{Name: "agent", Image: "a:v1", Args: []string{"--v=3"},
+				Env: []corev1.EnvVar{{Name: "USER_TOKEN", Value: "old"}, {Name: "REMOVED", Value: "x"}}},
+			{Name: "sidecar", Image: "s:v1"},
+		},
+		Volumes: []corev1.Volume{{Name: "certs", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "old-certs"}}}},
+	}
+	desired := &corev1.PodSpec{
+		ServiceAccountName: "bcs-kube-agent-v2",
+		Containers: []corev1.Container{
+			{Name: "agent", Image: "a:v2", Args: []string{"--v=4"},
+				Env: []corev1.EnvVar{{Name: "USER_TOKEN", Value: "new"}, {Name: "ADDED", Value: "y"}}},
+		},
+		HostAliases: []corev1.HostAlias{{IP: "10.0.0.2", Hostnames: []string{"bcs-api.example.com"}}},
+		Volumes: []corev1.Volume{{Name: "certs", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "bcs-certs"}}}},
+	}
+	want := []string{
+		"~ container agent image a:v1 -> a:v2",
+		"~ container agent args [--v=3] -> [--v=4]",
+		"~ container agent env USER_TOKEN ****** -> ******",
+		"+ container agent env ADDED=y",
+		"- container agent env REMOVED",
+		"- container sidecar",
+		"~ serviceAccountName bcs-kube-agent -> bcs-kube-agent-v2",
+		"~ hostAliases [] -> [10.0.0.2=bcs-api.example.com]",
+		"~ secret volumes map[certs:old-certs] -> map[certs:bcs-certs]",
+	}
+	if got := diffPodSpec(existing, desired); !reflect.DeepEqual(got, want) {
+		t.Errorf("diff\n%v\nwant\n%v", got, want)
+	}
+	if got := diffPodSpec(desired, desired); len(got) != 0 {
+		t.Errorf("diff of same spec %v", got)
+	}
+}
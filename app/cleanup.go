@@ -0,0 +1,598 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// cleanup modes
+const (
+	cleanupModeScale  = "scale"
+	cleanupModeDelete = "delete"
+)
+
+const defaultBackupDir = "./backups"
+
+// backup objects are applied in this order when restored
+var backupOrder = []string{"ServiceAccount", "Secret", "ClusterRole", "Role", "ClusterRoleBinding",
+	"RoleBinding", "Deployment"}
+
+// oldComponent Deployment of the old bcs kube agent or bcs k8s watch
+type oldComponent struct {
+	name      string
+	namespace string
+}
+
+// backupObject object of old component which is backed up before cleanup
+type backupObject struct {
+	kind      string
+	namespace string
+	name      string
+	obj       runtime.Object
+}
+
+// DoCleanup back up and scale down or delete the old bcs kube agent and bcs k8s watch in migrated clusters,
+// only clusters whose new bcs kube agent is ready and reachable through bcs api gateway are cleaned up
+func (app *App) DoCleanup(ctx context.Context) error {
+	mode := cleanupMode(app.op)
+	if mode != cleanupModeScale && mode != cleanupModeDelete {
+		return fmt.Errorf("unknown cleanup mode %s", mode)
+	}
+
+	err := app.initClients()
+	if err != nil {
+		return err
+	}
+	defer app.closeClients()
+
+	ctx, unlock, err := app.lockRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	migrated, changedClusters, err := app.listMigratedClusters(ctx)
+	if err != nil {
+		return err
+	}
+	blog.Infof("will cleanup %d migrated clusters, mode %s", len(migrated), mode)
+
+	failedClusters := newClusterErrors()
+	app.parallelize(ctx, len(migrated), func(ctx context.Context, i int) {
+		c := migrated[i]
+		origin := changedClusters.origin(c.ClusterID)
+		err := verifyKubeAgent(ctx, app.clusterOption(changedClusters.origin(c.ClusterID)), c, changedClusters)
+		if err != nil {
+			blog.Errorf("new kube agent for cluster %s[%s] not ready, skipping cleanup, %v",
+				c.ClusterName, c.ClusterID, err)
+			app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseVerify,
+				statusFailed, err.Error())
+			failedClusters.add(c.ClusterID, err)
+			return
+		}
+		app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseVerify, statusSuccess, "")
+
+		err = app.cleanupOldComponents(ctx, c, changedClusters)
+		if err != nil {
+			blog.Errorf("cleanup old components for cluster %s[%s] failed, %v", c.ClusterName, c.ClusterID, err)
+			app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseCleanup,
+				statusFailed, err.Error())
+			failedClusters.add(c.ClusterID, err)
+			return
+		}
+		status := statusSuccess
+		if app.op.DryRun {
+			status = statusPlanned
+		}
+		app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseCleanup, status, "")
+		blog.Infof("cleanup old components for cluster %s[%s] success", c.ClusterName, c.ClusterID)
+	})
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if app.op.DryRun {
+		app.printDryRunChanges()
+	}
+	if failed := failedClusters.all(); len(failed) > 0 {
+		return fmt.Errorf("%d clusters failed to cleanup: %v", len(failed), failed)
+	}
+
+	return nil
+}
+
+func cleanupMode(op *options.UpgradeOption) string {
+	if op.Cleanup.Mode == "" {
+		return cleanupModeScale
+	}
+	return op.Cleanup.Mode
+}
+
+func backupDir(op *options.UpgradeOption) string {
+	if op.Cleanup.BackupDir == "" {
+		return defaultBackupDir
+	}
+	return op.Cleanup.BackupDir
+}
+
+// oldComponents the old bcs kube agent and bcs k8s watch
+func oldComponents(op *options.UpgradeOption) []oldComponent {
+	watchNamespace := op.K8SWatch.Namespace
+	if watchNamespace == "" {
+		watchNamespace = op.KubeAgent.Namespace
+	}
+	return []oldComponent{
+		{name: oldKubeAgentName, namespace: op.KubeAgent.Namespace},
+		{name: oldK8SWatchName, namespace: watchNamespace},
+	}
+}
+
+// cleanupOldComponents back up the old components of cluster and scale down or delete them
+func (app *App) cleanupOldComponents(ctx context.Context, cluster types.ClusterM,
+	changeClusters *clusterIDMapping) error {
+	origin := changeClusters.origin(cluster.ClusterID)
+	op := app.clusterOption(origin)
+	config, err := generateRestConfig(ctx, op, cluster, origin)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	vars := newManifestVars(op, cluster, origin)
+	inUse, err := newComponentsInUse(ctx, op, config, clientset, vars)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(backupDir(op), cluster.ClusterID)
+	for _, component := range oldComponents(op) {
+		objects, err := collectOldComponent(ctx, clientset, component)
+		if err != nil {
+			return err
+		}
+		if len(objects) == 0 {
+			blog.Infof("%s/%s not found in cluster %s, skipping...", component.namespace, component.name,
+				cluster.ClusterID)
+			continue
+		}
+
+		if op.DryRun {
+			app.recordChange("back up %d objects of %s/%s in cluster %s[%s] into %s", len(objects),
+				component.namespace, component.name, cluster.ClusterName, cluster.ClusterID, dir)
+		} else {
+			err = writeBackup(dir, objects)
+			app.report.recordCluster(origin, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+				phaseBackup, statusOf(errString(err)), errString(err))
+			if err != nil {
+				return err
+			}
+		}
+
+		if cleanupMode(op) == cleanupModeScale {
+			err = app.scaleDeployment(ctx, clientset, cluster, component.namespace, component.name, 0)
+		} else {
+			err = app.deleteOldComponent(ctx, clientset, cluster, objects, inUse)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// newComponentsInUse service accounts and secrets used by the new bcs kube agent and bcs k8s watch,
+// they are shared with the old components and never deleted
+func newComponentsInUse(ctx context.Context, op *options.UpgradeOption, config *rest.Config,
+	clientset *kubernetes.Clientset, vars *manifestVars) (map[string]bool, error) {
+	deployments, err := kubeAgentDeployments(ctx, op, config, clientset, vars)
+	if err != nil {
+		return nil, err
+	}
+	inUse := map[string]bool{objectKey("Secret", op.KubeAgent.Namespace, op.BCSCertName): true}
+	if op.K8SWatch.Enable {
+		inUse[objectKey("Secret", op.K8SWatch.Namespace, op.BCSCertName)] = true
+		rendered, err := loadDeployment(op.K8SWatch.YamlPath)
+		if err != nil {
+			return nil, err
+		}
+		watch, err := clientset.AppsV1().Deployments(op.K8SWatch.Namespace).Get(ctx, rendered.Name,
+			metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			deployments = append(deployments, watch)
+		}
+	}
+
+	for _, deployment := range deployments {
+		inUse[objectKey("ServiceAccount", deployment.Namespace, serviceAccountOf(deployment))] = true
+		for _, secret := range secretsOf(deployment) {
+			inUse[objectKey("Secret", deployment.Namespace, secret)] = true
+		}
+	}
+
+	return inUse, nil
+}
+
+func objectKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+func serviceAccountOf(deployment *appsv1.Deployment) string {
+	if deployment.Spec.Template.Spec.ServiceAccountName != "" {
+		return deployment.Spec.Template.Spec.ServiceAccountName
+	}
+	return "default"
+}
+
+func secretsOf(deployment *appsv1.Deployment) []string {
+	secrets := make([]string, 0)
+	for _, v := range deployment.Spec.Template.Spec.Volumes {
+		if v.Secret != nil {
+			secrets = append(secrets, v.Secret.SecretName)
+		}
+	}
+	return secrets
+}
+
+// oldImageRepo image repository and service account of the old component in cluster, they are read from the
+// backup written by cleanup when the old Deployment has been deleted, and default to imageRepo and
+// serviceAccount when there is no backup either
+func oldImageRepo(ctx context.Context, op *options.UpgradeOption, clientset kubernetes.Interface, clusterID string,
+	component oldComponent, imageRepo, serviceAccount string) (string, string, error) {
+	deployment, err := clientset.AppsV1().Deployments(component.namespace).
+		Get(ctx, component.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		deployment, err = loadBackupDeployment(op, clusterID, component)
+		if os.IsNotExist(err) {
+			if imageRepo == "" && serviceAccount == "" {
+				return "", "", fmt.Errorf("%s/%s is not found in cluster %s and has no backup",
+					component.namespace, component.name, clusterID)
+			}
+			blog.Warnf("%s/%s is not found in cluster %s and has no backup, using image repo %s and "+
+				"service account %s", component.namespace, component.name, clusterID, imageRepo, serviceAccount)
+			return imageRepo, serviceAccount, nil
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	containers := deployment.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return "", "", fmt.Errorf("%s/%s has no containers", component.namespace, component.name)
+	}
+	image := containers[0].Image
+	return image[:strings.LastIndex(image, "/")+1], deployment.Spec.Template.Spec.ServiceAccountName, nil
+}
+
+// loadBackupDeployment Deployment of the old component backed up by cleanup
+func loadBackupDeployment(op *options.UpgradeOption, clusterID string,
+	component oldComponent) (*appsv1.Deployment, error) {
+	path := filepath.Join(backupDir(op), clusterID, backupFileName(backupObject{kind: "Deployment",
+		namespace: component.namespace, name: component.name}))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decode backup %s failed, %v", path, err)
+	}
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		return nil, fmt.Errorf("backup %s is not a Deployment", path)
+	}
+	blog.Infof("%s/%s is not found, using its backup %s", component.namespace, component.name, path)
+	return deployment, nil
+}
+
+// collectOldComponent get Deployment of old component with its ServiceAccount, RBAC and Secrets,
+// nothing is returned if the Deployment is not found
+func collectOldComponent(ctx context.Context, clientset *kubernetes.Clientset,
+	component oldComponent) ([]backupObject, error) {
+	namespace := component.namespace
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, component.name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	objects := []backupObject{{kind: "Deployment", namespace: namespace, name: deployment.Name, obj: deployment}}
+
+	secrets := secretsOf(deployment)
+	saName := serviceAccountOf(deployment)
+	if saName != "default" {
+		sa, err := clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, saName, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			objects = append(objects, backupObject{kind: "ServiceAccount", namespace: namespace, name: sa.Name,
+				obj: sa})
+			for _, ref := range sa.Secrets {
+				secrets = append(secrets, ref.Name)
+			}
+		}
+
+		rbac, err := collectRBAC(ctx, clientset, namespace, saName)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, rbac...)
+	}
+
+	seen := make(map[string]bool, 0)
+	for _, name := range secrets {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		objects = append(objects, backupObject{kind: "Secret", namespace: namespace, name: name, obj: secret})
+	}
+
+	return objects, nil
+}
+
+// collectRBAC get bindings whose subjects include the service account and the roles they refer to
+func collectRBAC(ctx context.Context, clientset *kubernetes.Clientset, namespace,
+	saName string) ([]backupObject, error) {
+	isSubject := func(subjects []rbacv1.Subject) bool {
+		for _, s := range subjects {
+			if s.Kind == rbacv1.ServiceAccountKind && s.Name == saName && s.Namespace == namespace {
+				return true
+			}
+		}
+		return false
+	}
+
+	objects := make([]backupObject, 0)
+	roleRefs := make([]rbacv1.RoleRef, 0)
+	crbs, err := clientset.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range crbs.Items {
+		if isSubject(crbs.Items[i].Subjects) {
+			objects = append(objects, backupObject{kind: "ClusterRoleBinding", name: crbs.Items[i].Name,
+				obj: &crbs.Items[i]})
+			roleRefs = append(roleRefs, crbs.Items[i].RoleRef)
+		}
+	}
+	rbs, err := clientset.RbacV1().RoleBindings(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range rbs.Items {
+		if isSubject(rbs.Items[i].Subjects) {
+			objects = append(objects, backupObject{kind: "RoleBinding", namespace: namespace, name: rbs.Items[i].Name,
+				obj: &rbs.Items[i]})
+			roleRefs = append(roleRefs, rbs.Items[i].RoleRef)
+		}
+	}
+
+	for _, ref := range roleRefs {
+		switch ref.Kind {
+		case "ClusterRole":
+			role, err := clientset.RbacV1().ClusterRoles().Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+			if err == nil {
+				objects = append(objects, backupObject{kind: "ClusterRole", name: role.Name, obj: role})
+			}
+		case "Role":
+			role, err := clientset.RbacV1().Roles(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+			if err == nil {
+				objects = append(objects, backupObject{kind: "Role", namespace: namespace, name: role.Name, obj: role})
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// writeBackup write objects as yaml into dir, backups written by an earlier run are kept as they are,
+// so that the replicas before scaling down are never lost
+func writeBackup(dir string, objects []backupObject) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, o := range objects {
+		path := filepath.Join(dir, backupFileName(o))
+		if _, err := os.Stat(path); err == nil {
+			blog.Infof("backup %s exists, skipping...", path)
+			continue
+		}
+		data, err := marshalBackup(o)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		blog.Infof("back up %s %s/%s to %s", o.kind, o.namespace, o.name, path)
+	}
+	return nil
+}
+
+func backupFileName(o backupObject) string {
+	order := len(backupOrder)
+	for i, kind := range backupOrder {
+		if kind == o.kind {
+			order = i
+		}
+	}
+	namespace := o.namespace
+	if namespace == "" {
+		namespace = "cluster"
+	}
+	return fmt.Sprintf("%d-%s-%s-%s.yaml", order, strings.ToLower(o.kind), namespace, o.name)
+}
+
+// marshalBackup marshal object without server generated fields
+func marshalBackup(o backupObject) ([]byte, error) {
+	obj := o.obj.DeepCopyObject()
+	gv := "v1"
+	switch o.kind {
+	case "Deployment":
+		gv = appsv1.SchemeGroupVersion.String()
+		obj.(*appsv1.Deployment).Status = appsv1.DeploymentStatus{}
+	case "ClusterRole", "Role", "ClusterRoleBinding", "RoleBinding":
+		gv = rbacv1.SchemeGroupVersion.String()
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	accessor.SetResourceVersion("")
+	accessor.SetUID("")
+	accessor.SetSelfLink("")
+	accessor.SetGeneration(0)
+	accessor.SetCreationTimestamp(metav1.Time{})
+	accessor.SetManagedFields(nil)
+	obj.GetObjectKind().SetGroupVersionKind(schema.FromAPIVersionAndKind(gv, o.kind))
+
+	return yaml.Marshal(obj)
+}
+
+// scaleDeployment scale Deployment of the old component
+func (app *App) scaleDeployment(ctx context.Context, clientset *kubernetes.Clientset, cluster types.ClusterM,
+	namespace, name string, replicas int32) error {
+	if app.op.DryRun {
+		app.recordChange("scale deployment %s/%s in cluster %s[%s] to %d", namespace, name,
+			cluster.ClusterName, cluster.ClusterID, replicas)
+		return nil
+	}
+	_, err := clientset.AppsV1().Deployments(namespace).UpdateScale(ctx, name, &autoscalingv1.Scale{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: autoscalingv1.ScaleSpec{Replicas: replicas},
+	}, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	blog.Infof("scale deployment %s/%s in cluster %s to %d", namespace, name, cluster.ClusterID, replicas)
+	return nil
+}
+
+// deleteOldComponent delete objects of the old component, objects used by the new components are kept,
+// ClusterRoles may be shared by other bindings and are only backed up
+func (app *App) deleteOldComponent(ctx context.Context, clientset *kubernetes.Clientset, cluster types.ClusterM,
+	objects []backupObject, inUse map[string]bool) error {
+	saInUse := false
+	for _, o := range objects {
+		if o.kind == "ServiceAccount" && inUse[objectKey(o.kind, o.namespace, o.name)] {
+			saInUse = true
+		}
+	}
+
+	// delete Deployment first and roles at last
+	for i := len(backupOrder) - 1; i >= 0; i-- {
+		for _, o := range objects {
+			if o.kind != backupOrder[i] {
+				continue
+			}
+			if inUse[objectKey(o.kind, o.namespace, o.name)] || (saInUse && isRBAC(o.kind)) {
+				blog.Infof("%s %s/%s is used by the new components, keeping it", o.kind, o.namespace, o.name)
+				continue
+			}
+			if o.kind == "ClusterRole" {
+				continue
+			}
+			if app.op.DryRun {
+				app.recordChange("delete %s %s/%s in cluster %s[%s]", o.kind, o.namespace, o.name,
+					cluster.ClusterName, cluster.ClusterID)
+				continue
+			}
+			if err := deleteObject(ctx, clientset, o); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			blog.Infof("delete %s %s/%s in cluster %s", o.kind, o.namespace, o.name, cluster.ClusterID)
+		}
+	}
+
+	return nil
+}
+
+func isRBAC(kind string) bool {
+	return kind == "ClusterRole" || kind == "Role" || kind == "ClusterRoleBinding" || kind == "RoleBinding"
+}
+
+func deleteObject(ctx context.Context, clientset *kubernetes.Clientset, o backupObject) error {
+	opts := metav1.DeleteOptions{}
+	switch o.kind {
+	case "Deployment":
+		return clientset.AppsV1().Deployments(o.namespace).Delete(ctx, o.name, opts)
+	case "ServiceAccount":
+		return clientset.CoreV1().ServiceAccounts(o.namespace).Delete(ctx, o.name, opts)
+	case "Secret":
+		return clientset.CoreV1().Secrets(o.namespace).Delete(ctx, o.name, opts)
+	case "ClusterRoleBinding":
+		return clientset.RbacV1().ClusterRoleBindings().Delete(ctx, o.name, opts)
+	case "RoleBinding":
+		return clientset.RbacV1().RoleBindings(o.namespace).Delete(ctx, o.name, opts)
+	case "Role":
+		return clientset.RbacV1().Roles(o.namespace).Delete(ctx, o.name, opts)
+	default:
+		return fmt.Errorf("unknown kind %s", o.kind)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/components"
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// initAPIClients create clients of apis which are not set
+func (app *App) initAPIClients() {
+	op := app.op
+	if app.projectManager == nil {
+		app.projectManager = components.NewProjectManager(op.BCSApiGateway.Addr, op.BCSApiGateway.Token, op.Debug,
+			op.Retry)
+	}
+	if app.clusterManager == nil {
+		app.clusterManager = components.NewClusterManager(op.BCSApiGateway.Addr, op.BCSApiGateway.Token, op.Debug,
+			op.Retry)
+	}
+	if app.bcsCc == nil {
+		app.bcsCc = components.NewBCSCc(op.BCSCc, op.Debug, op.Retry)
+	}
+}
+
+// newBCSApi client of bcs api in 1.18, kube configs of clusters are got from it
+func newBCSApi(op *options.UpgradeOption) components.BCSApi {
+	return components.NewBCSApi(op.BCSApi.Addr, op.BCSApi.Token, op.Debug, op.Retry)
+}
+
+// how clusters are written into cluster manager
+const (
+	clusterWriteModeMongo = "mongo"
+	clusterWriteModeAPI   = "api"
+)
+
+// checkClusterWriteMode cluster_write_mode is mongo by default
+func checkClusterWriteMode(op *options.UpgradeOption) error {
+	switch op.ClusterWriteMode {
+	case "", clusterWriteModeMongo, clusterWriteModeAPI:
+		return nil
+	default:
+		return fmt.Errorf("unknown cluster_write_mode %s", op.ClusterWriteMode)
+	}
+}
+
+// insertClusterM import cluster into cluster manager through its api behind bcs api gateway, or insert it
+// into mongoDB directly
+func (app *App) insertClusterM(ctx context.Context, cluster types.ClusterM) error {
+	if app.op.ClusterWriteMode == clusterWriteModeAPI {
+		_, err := app.clusterManager.CreateCluster(ctx, components.NewCreateClusterRequest(&cluster))
+		return err
+	}
+
+	return app.store.insertCluster(ctx, cluster)
+}
+
+// deleteClusterM delete cluster inserted into cluster manager
+func (app *App) deleteClusterM(ctx context.Context, cluster types.ClusterM) error {
+	if app.op.ClusterWriteMode == clusterWriteModeAPI {
+		err := app.clusterManager.DeleteCluster(ctx, cluster.ClusterID)
+		if components.IsNotFound(err) {
+			blog.Warnf("cluster %s[%s] not found in cluster manager", cluster.ClusterName, cluster.ClusterID)
+			return nil
+		}
+		return err
+	}
+
+	deleted, err := app.store.deleteCluster(ctx, cluster.ClusterID, cluster.ProjectID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		blog.Warnf("cluster %s[%s] not found in cluster manager", cluster.ClusterName, cluster.ClusterID)
+	}
+	return nil
+}
+
+// isClusterDuplicated the clusterID is already taken in cluster manager
+func isClusterDuplicated(err error) bool {
+	return components.IsAlreadyExists(err) || errors.Is(err, errClusterExists)
+}
@@ -0,0 +1,171 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"github.com/jinzhu/gorm"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+// bcsAPITokenQuery the latest unexpired token of super users of the old bcs api, bke_core is the database of
+// the old bcs api and is in the same mysql as bk_bcs_cc
+const bcsAPITokenQuery = "SELECT t.value FROM bke_core.user_tokens t JOIN bke_core.users u ON u.id = t.user_id " +
+	"WHERE u.is_super_user = ? AND (t.expires_at IS NULL OR t.expires_at > ?) ORDER BY t.id DESC LIMIT 1"
+
+// objects in bcs-system of the blueking cluster holding the gateway token and the bcs cert name
+const (
+	bcsSystemNamespace = "bcs-system"
+	bcsPasswordSecret  = "bcs-password"
+	gatewayTokenKey    = "gateway_token"
+	bkKubeAgentName    = "bcs-kube-agent"
+	bcsCertsVolume     = "bcs-certs"
+)
+
+// discover fill bcs_api.token, bcs_api_gateway.token and bcs_cert_name left empty in config, the bcs api token
+// is read from bke_core in mysql, the others from bcs-system of the blueking cluster
+func (app *App) discover(ctx context.Context) error {
+	op := app.op
+	if op.BCSApi.Token == "" {
+		if app.sqlClient == nil {
+			if err := app.initMysqlClient(); err != nil {
+				return fmt.Errorf("discover bcs_api.token failed, %v", err)
+			}
+		}
+		token, err := app.discoverBCSApiToken(ctx)
+		if err != nil {
+			return fmt.Errorf("discover bcs_api.token failed, %v", err)
+		}
+		op.BCSApi.Token = token
+		options.AddSecrets(token)
+		blog.Infof("discovered bcs_api.token from bke_core.user_tokens")
+	}
+
+	if op.BCSApiGateway.Token == "" {
+		token, err := discoverGatewayToken(ctx, op)
+		if err != nil {
+			return fmt.Errorf("discover bcs_api_gateway.token failed, %v", err)
+		}
+		op.BCSApiGateway.Token = token
+		options.AddSecrets(token)
+		blog.Infof("discovered bcs_api_gateway.token from secret %s/%s", bcsSystemNamespace, bcsPasswordSecret)
+	}
+
+	if op.BCSCertName == "" && (op.KubeAgent.Enable || op.K8SWatch.Enable) {
+		name, err := discoverCertName(ctx, op)
+		if err != nil {
+			return fmt.Errorf("discover bcs_cert_name failed, %v", err)
+		}
+		op.BCSCertName = name
+		blog.Infof("discovered bcs_cert_name %s from deployment %s/%s", name, bcsSystemNamespace, bkKubeAgentName)
+	}
+
+	return nil
+}
+
+// discoverBCSApiToken token of super users of the old bcs api in bke_core.user_tokens
+func (app *App) discoverBCSApiToken(ctx context.Context) (string, error) {
+	var token string
+	err := app.readOnly(ctx, func(tx *gorm.DB) error {
+		return tx.Raw(bcsAPITokenQuery, true, time.Now()).Row().Scan(&token)
+	})
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no unexpired token of super users in bke_core.user_tokens")
+	}
+	if err != nil {
+		return "", fmt.Errorf("query bke_core.user_tokens failed, %v", err)
+	}
+	return token, nil
+}
+
+// discoverGatewayToken gateway_token in secret bcs-password of the blueking cluster, the cluster is accessed
+// by bk_cluster_kubeconfig since the gateway needs the token
+func discoverGatewayToken(ctx context.Context, op *options.UpgradeOption) (string, error) {
+	if op.BKClusterKubeconfig == "" {
+		return "", fmt.Errorf("bk_cluster_kubeconfig is needed to read secret %s/%s of the blueking cluster",
+			bcsSystemNamespace, bcsPasswordSecret)
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", op.BKClusterKubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("load bk_cluster_kubeconfig failed, %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.CoreV1().Secrets(bcsSystemNamespace).Get(ctx, bcsPasswordSecret, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	token := string(secret.Data[gatewayTokenKey])
+	if token == "" {
+		return "", fmt.Errorf("no %s in secret %s/%s", gatewayTokenKey, bcsSystemNamespace, bcsPasswordSecret)
+	}
+	return token, nil
+}
+
+// discoverCertName name of the secret mounted as volume bcs-certs by bcs-kube-agent of the blueking cluster,
+// the secret is either the volume source or one of its projected sources
+func discoverCertName(ctx context.Context, op *options.UpgradeOption) (string, error) {
+	client, err := kubernetes.NewForConfig(bkClusterConfig(op))
+	if err != nil {
+		return "", err
+	}
+	deployment, err := client.AppsV1().Deployments(bcsSystemNamespace).Get(ctx, bkKubeAgentName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	for _, volume := range deployment.Spec.Template.Spec.Volumes {
+		if volume.Name != bcsCertsVolume {
+			continue
+		}
+		if volume.Secret != nil && volume.Secret.SecretName != "" {
+			return volume.Secret.SecretName, nil
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name != "" {
+					return source.Secret.Name, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no secret in volume %s of deployment %s/%s", bcsCertsVolume, bcsSystemNamespace,
+		bkKubeAgentName)
+}
+
+// bkClusterConfig rest config of the blueking cluster through bcs api gateway
+func bkClusterConfig(op *options.UpgradeOption) *rest.Config {
+	return &rest.Config{
+		Host:        op.BCSApiGateway.Addr + "/clusters/" + op.BKClusterID,
+		BearerToken: op.BCSApiGateway.Token,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: true,
+		},
+		QPS:   100,
+		Burst: 100,
+	}
+}
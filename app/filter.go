@@ -0,0 +1,96 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+// clusters are migrated only in this status unless filter.statuses is set
+const defaultClusterStatus = "normal"
+
+// checkFilter filter.disabled is empty, true or false and filter.name_regex compiles, so that a mistyped filter
+// never selects the wrong clusters
+func checkFilter(op *options.UpgradeOption) error {
+	switch op.Filter.Disabled {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid filter.disabled %q, it must be empty, true or false", op.Filter.Disabled)
+	}
+	if _, err := regexp.Compile(op.Filter.NameRegex); err != nil {
+		return fmt.Errorf("invalid filter.name_regex, %v", err)
+	}
+	return nil
+}
+
+// projectSelectors query projects by project_ids, filter.exclude_project_ids and filter.business_ids
+func (app *App) projectSelectors(db *gorm.DB) *gorm.DB {
+	f := app.op.Filter
+	if len(app.op.ProjectIDs) != 0 {
+		db = db.Where("project_id IN (?)", app.op.ProjectIDs)
+	}
+	if len(f.ExcludeProjectIDs) != 0 {
+		db = db.Where("project_id NOT IN (?)", f.ExcludeProjectIDs)
+	}
+	if len(f.BusinessIDs) != 0 {
+		db = db.Where("cc_app_id IN (?)", f.BusinessIDs)
+	}
+	return db
+}
+
+// clusterSelectors query clusters by filter, name_regex is matched after query and selectors of projects
+// are applied separately
+func (app *App) clusterSelectors(db *gorm.DB) *gorm.DB {
+	f := app.op.Filter
+	statuses := f.Statuses
+	if len(statuses) == 0 {
+		statuses = []string{defaultClusterStatus}
+	}
+	db = db.Where("status IN (?)", statuses)
+	if len(f.ClusterIDs) != 0 {
+		db = db.Where("cluster_id IN (?)", f.ClusterIDs)
+	}
+	if len(f.ExcludeClusterIDs) != 0 {
+		db = db.Where("cluster_id NOT IN (?)", f.ExcludeClusterIDs)
+	}
+	if len(f.Environments) != 0 {
+		db = db.Where("environment IN (?)", f.Environments)
+	}
+	if len(f.Types) != 0 {
+		db = db.Where("`type` IN (?)", f.Types)
+	}
+	if f.Disabled != "" {
+		db = db.Where("disabled = ?", f.Disabled == "true")
+	}
+	if len(f.States) != 0 {
+		db = db.Where("state IN (?)", f.States)
+	}
+	return db
+}
+
+func hasProjectSelectors(op *options.UpgradeOption) bool {
+	f := op.Filter
+	return len(op.ProjectIDs) != 0 || len(f.ExcludeProjectIDs) != 0 || len(f.BusinessIDs) != 0
+}
+
+func hasClusterSelectors(op *options.UpgradeOption) bool {
+	f := op.Filter
+	return len(f.ClusterIDs) != 0 || len(f.ExcludeClusterIDs) != 0 || len(f.Environments) != 0 ||
+		len(f.Types) != 0 || f.Disabled != "" || len(f.States) != 0 || len(f.Statuses) != 0 || f.NameRegex != ""
+}
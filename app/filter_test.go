@@ -0,0 +1,71 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"testing"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+func TestCheckFilter(t *testing.T) {
+	tests := []struct {
+		disabled  string
+		nameRegex string
+		wantErr   bool
+	}{
+		{"", "", false},
+		{"true", "", false},
+		{"false", "^prod-", false},
+		{"True", "", true},
+		{"yes", "", true},
+		{"1", "", true},
+		{"", "prod-(", true},
+	}
+	for _, tt := range tests {
+		op := &options.UpgradeOption{}
+		op.Filter.Disabled = tt.disabled
+		op.Filter.NameRegex = tt.nameRegex
+		if err := checkFilter(op); (err != nil) != tt.wantErr {
+			t.Errorf("disabled %q name_regex %q: err %v, want error %v", tt.disabled, tt.nameRegex, err,
+				tt.wantErr)
+		}
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		set      func(op *options.UpgradeOption)
+		projects bool
+		clusters bool
+	}{
+		{"empty", func(op *options.UpgradeOption) {}, false, false},
+		{"project_ids", func(op *options.UpgradeOption) { op.ProjectIDs = []string{"p1"} }, true, false},
+		{"business_ids", func(op *options.UpgradeOption) { op.Filter.BusinessIDs = []uint{1} }, true, false},
+		{"disabled", func(op *options.UpgradeOption) { op.Filter.Disabled = "false" }, false, true},
+		{"statuses", func(op *options.UpgradeOption) { op.Filter.Statuses = []string{"normal"} }, false, true},
+		{"name_regex", func(op *options.UpgradeOption) { op.Filter.NameRegex = "prod" }, false, true},
+	}
+	for _, tt := range tests {
+		op := &options.UpgradeOption{}
+		tt.set(op)
+		if got := hasProjectSelectors(op); got != tt.projects {
+			t.Errorf("%s: hasProjectSelectors %v, want %v", tt.name, got, tt.projects)
+		}
+		if got := hasClusterSelectors(op); got != tt.clusters {
+			t.Errorf("%s: hasClusterSelectors %v, want %v", tt.name, got, tt.clusters)
+		}
+	}
+}
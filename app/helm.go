@@ -0,0 +1,333 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+const (
+	defaultKubeAgentRelease = "bcs-kube-agent-v2"
+	kubeAgentWebsocketPath  = "/bcsapi/v4/clustermanager/v1/websocket/connect"
+	// releaseManagedByValue value of releases installed by upgrade tool, set to managedByUpgradeTool
+	releaseManagedByValue = "managedBy"
+)
+
+// kubeAgentByHelm whether the new bcs kube agent is installed from helm_package_path instead of yaml_path
+func kubeAgentByHelm(op *options.UpgradeOption) bool {
+	return op.KubeAgent.HelmPackagePath != ""
+}
+
+func kubeAgentRelease(op *options.UpgradeOption) string {
+	if op.KubeAgent.ReleaseName != "" {
+		return op.KubeAgent.ReleaseName
+	}
+	return defaultKubeAgentRelease
+}
+
+// newHelmConfig init helm action configuration through the old bcs api tunnel of cluster
+func newHelmConfig(config *rest.Config, namespace string) (*action.Configuration, error) {
+	actionConfig := new(action.Configuration)
+	err := actionConfig.Init(GetHelmConfig(config.Host, config.BearerToken, "", namespace), namespace,
+		os.Getenv("HELM_DRIVER"), blog.Infof)
+	if err != nil {
+		return nil, fmt.Errorf("init helm config failed, %v", err)
+	}
+	return actionConfig, nil
+}
+
+// applyKubeAgentRelease create or update the cert secret and install or upgrade the bcs kube agent release,
+// Deployments in the release manifest are returned for rollout check
+func (app *App) applyKubeAgentRelease(ctx context.Context, op *options.UpgradeOption, config *rest.Config,
+	clientset kubernetes.Interface, cluster types.ClusterM, originClusterID string,
+	secret *corev1.Secret) ([]*appsv1.Deployment, error) {
+	result, diff, err := applySecret(ctx, clientset, secret, op.DryRun)
+	app.recordApply(cluster, originClusterID, stepSecretCreated, "secret "+secret.Namespace+"/"+secret.Name,
+		result, diff, err)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := renderKubeAgentValues(ctx, op, clientset, cluster.ClusterID)
+	if err != nil {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepAgentDeployed, err.Error())
+		return nil, err
+	}
+
+	namespace, name := op.KubeAgent.Namespace, kubeAgentRelease(op)
+	result, diff, rel, err := applyRelease(config, op.KubeAgent.HelmPackagePath, namespace, name, values, op.DryRun)
+	app.recordApply(cluster, originClusterID, stepAgentDeployed, "helm release "+namespace+"/"+name,
+		result, diff, err)
+	if err != nil || rel == nil {
+		return nil, err
+	}
+
+	return releaseDeployments(rel)
+}
+
+// renderKubeAgentValues values of the bcs kube agent chart, the image repository is the same as the old
+// bcs kube agent, hostAliases resolve the gateway to bcs_api_gateway.ip if it is set
+func renderKubeAgentValues(ctx context.Context, op *options.UpgradeOption, clientset kubernetes.Interface,
+	clusterID string) (map[string]interface{}, error) {
+	imageRepo, _, err := oldImageRepo(ctx, op, clientset, clusterID,
+		oldComponent{name: oldKubeAgentName, namespace: op.KubeAgent.Namespace}, op.KubeAgent.ImageRepo,
+		op.KubeAgent.ServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	imageInfo := strings.Split(op.KubeAgent.Image, ":")
+	if len(imageInfo) != 2 {
+		return nil, fmt.Errorf("invalid bcs kube agent image")
+	}
+
+	gAddr := strings.Split(op.BCSApiGateway.Addr, "//")
+	if len(gAddr) != 2 {
+		return nil, fmt.Errorf("invalid bcs api gateway address")
+	}
+
+	values := map[string]interface{}{
+		releaseManagedByValue: managedByUpgradeTool,
+		"image": map[string]interface{}{
+			"registry":   "",
+			"repository": imageRepo + imageInfo[0],
+			"tag":        imageInfo[1],
+		},
+		"args": map[string]interface{}{
+			"BK_BCS_API":                fmt.Sprintf("wss://%s", gAddr[1]),
+			"BK_BCS_clusterId":          clusterID,
+			"BK_BCS_insecureSkipVerify": "true",
+			"BK_BCS_kubeAgentWSTunnel":  "true",
+			"BK_BCS_websocketPath":      kubeAgentWebsocketPath,
+			"BK_BCS_APIToken":           op.BCSApiGateway.Token,
+		},
+	}
+	// the gateway is resolved by ip as in the manifest, the chart has to render hostAliases into the pod
+	if op.BCSApiGateway.IP != "" {
+		values["hostAliases"] = []interface{}{
+			map[string]interface{}{
+				"ip":        op.BCSApiGateway.IP,
+				"hostnames": []interface{}{gAddr[1]},
+			},
+		}
+	}
+	return values, nil
+}
+
+// applyRelease install release from chart package at path, or upgrade it if chart version or values differ,
+// the release is nil in dry run
+func applyRelease(config *rest.Config, path, namespace, name string, values map[string]interface{},
+	dryRun bool) (string, []string, *release.Release, error) {
+	ch, err := loader.Load(path)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("load helm package %s failed, %v", path, err)
+	}
+	if _, ok := values["hostAliases"]; ok && !chartReferences(ch, "hostAliases") {
+		return "", nil, nil, fmt.Errorf("templates of helm package %s do not use hostAliases, which is needed "+
+			"to resolve bcs api gateway to bcs_api_gateway.ip", path)
+	}
+	actionConfig, err := newHelmConfig(config, namespace)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	existing, err := action.NewGet(actionConfig).Run(name)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		diff := []string{fmt.Sprintf("+ chart %s-%s", ch.Metadata.Name, ch.Metadata.Version)}
+		if dryRun {
+			return applyCreated, diff, nil, nil
+		}
+		install := action.NewInstall(actionConfig)
+		install.Namespace = namespace
+		install.ReleaseName = name
+		rel, err := install.Run(ch, values)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("install release %s/%s failed, %v", namespace, name, err)
+		}
+		return applyCreated, diff, rel, nil
+	}
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("get release %s/%s failed, %v", namespace, name, err)
+	}
+
+	diff := diffRelease(existing, ch, values)
+	if len(diff) == 0 {
+		return applyUnchanged, nil, existing, nil
+	}
+	if dryRun {
+		return applyUpdated, diff, nil, nil
+	}
+	upgrade := action.NewUpgrade(actionConfig)
+	upgrade.Namespace = namespace
+	rel, err := upgrade.Run(name, ch, values)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("upgrade release %s/%s failed, %v", namespace, name, err)
+	}
+	return applyUpdated, diff, rel, nil
+}
+
+// chartReferences whether templates of chart or its dependencies reference .Values.key
+func chartReferences(ch *chart.Chart, key string) bool {
+	for _, t := range ch.Templates {
+		if strings.Contains(string(t.Data), ".Values."+key) {
+			return true
+		}
+	}
+	for _, dep := range ch.Dependencies() {
+		if chartReferences(dep, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRelease differences of a deployed release from the chart and values, token values are never in diff
+func diffRelease(existing *release.Release, ch *chart.Chart, values map[string]interface{}) []string {
+	diff := make([]string, 0)
+	if existing.Info != nil && existing.Info.Status != release.StatusDeployed {
+		diff = append(diff, fmt.Sprintf("~ status %s", existing.Info.Status))
+	}
+	if existing.Chart != nil && existing.Chart.Metadata != nil &&
+		existing.Chart.Metadata.Version != ch.Metadata.Version {
+		diff = append(diff, fmt.Sprintf("~ chart version %s -> %s", existing.Chart.Metadata.Version,
+			ch.Metadata.Version))
+	}
+
+	current, desired := flattenValues("", existing.Config), flattenValues("", values)
+	keys := make([]string, 0)
+	for k := range current {
+		keys = append(keys, k)
+	}
+	for k := range desired {
+		if _, ok := current[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if reflect.DeepEqual(current[k], desired[k]) {
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("~ values %s %v -> %v", k, redactEnv(k, fmt.Sprint(current[k])),
+			redactEnv(k, fmt.Sprint(desired[k]))))
+	}
+	return diff
+}
+
+// flattenValues flatten nested values into keys like args.BK_BCS_API
+func flattenValues(prefix string, values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, 0)
+	for k, v := range values {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range flattenValues(key, nested) {
+				result[nk] = nv
+			}
+			continue
+		}
+		result[key] = v
+	}
+	return result
+}
+
+// releaseDeployments Deployments in the manifest of release
+func releaseDeployments(rel *release.Release) ([]*appsv1.Deployment, error) {
+	deployments := make([]*appsv1.Deployment, 0)
+	for _, manifest := range releaseutil.SplitManifests(rel.Manifest) {
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode([]byte(manifest), nil, nil)
+		if err != nil {
+			continue
+		}
+		deployment, ok := obj.(*appsv1.Deployment)
+		if !ok {
+			continue
+		}
+		if deployment.Namespace == "" {
+			deployment.Namespace = rel.Namespace
+		}
+		deployments = append(deployments, deployment)
+	}
+	if len(deployments) == 0 {
+		return nil, fmt.Errorf("no deployment found in release %s/%s", rel.Namespace, rel.Name)
+	}
+	return deployments, nil
+}
+
+// getReleaseDeployments Deployments of the deployed release, nil if the release is not found
+func getReleaseDeployments(config *rest.Config, namespace, name string) ([]*appsv1.Deployment, error) {
+	actionConfig, err := newHelmConfig(config, namespace)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := action.NewGet(actionConfig).Run(name)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get release %s/%s failed, %v", namespace, name, err)
+	}
+	return releaseDeployments(rel)
+}
+
+// uninstallRelease uninstall release, releases not found or not installed by upgrade tool, i.e. without the
+// value managedBy=bcs-upgradetool, are ignored
+func uninstallRelease(config *rest.Config, namespace, name string) error {
+	actionConfig, err := newHelmConfig(config, namespace)
+	if err != nil {
+		return err
+	}
+	existing, err := action.NewGet(actionConfig).Run(name)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get release %s/%s failed, %v", namespace, name, err)
+	}
+	if existing.Config[releaseManagedByValue] != managedByUpgradeTool {
+		blog.Infof("release %s/%s is not installed by upgrade tool, keeping it", namespace, name)
+		return nil
+	}
+	_, err = action.NewUninstall(actionConfig).Run(name)
+	if err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+		return fmt.Errorf("uninstall release %s/%s failed, %v", namespace, name, err)
+	}
+	blog.Infof("uninstall release %s/%s success", namespace, name)
+	return nil
+}
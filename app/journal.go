@@ -0,0 +1,274 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+// steps of project and cluster migration recorded in journal
+const (
+	stepProjectCreated     = "project_created"
+	stepProjectExisted     = "project_existed"
+	stepClusterIDAllocated = "cluster_id_allocated"
+	stepClusterInserted    = "cluster_inserted"
+	stepClusterSyncedToCc  = "cluster_synced_to_cc"
+	stepClusterStatus      = "cluster_status_updated"
+	stepSecretCreated      = "secret_created"
+	stepAgentObjects       = "agent_objects_applied"
+	stepAgentDeployed      = "agent_deployed"
+	stepAgentReady         = "agent_ready"
+	stepAgentRegistered    = "agent_registered"
+	stepWatchSecretCreated = "watch_secret_created"
+	stepWatchDeployed      = "watch_deployed"
+	stepWatchReady         = "watch_ready"
+)
+
+const defaultJournalPath = "./migrate-journal.json"
+
+// projectRecord migration progress of project
+type projectRecord struct {
+	ProjectID string            `json:"projectID"`
+	Name      string            `json:"name"`
+	Steps     map[string]string `json:"steps"`
+	LastError string            `json:"lastError,omitempty"`
+}
+
+// clusterRecord migration progress of cluster, keyed by clusterID in 1.18
+type clusterRecord struct {
+	OriginClusterID string            `json:"originClusterID"`
+	ClusterID       string            `json:"clusterID"`
+	ProjectID       string            `json:"projectID"`
+	ClusterName     string            `json:"clusterName"`
+	Steps           map[string]string `json:"steps"`
+	LastError       string            `json:"lastError,omitempty"`
+}
+
+// journal persist every step of project and cluster migration to a local file,
+// so that a rerun resumes from the exact step where the last run stopped
+type journal struct {
+	lock     sync.Mutex
+	path     string
+	readOnly bool
+
+	Projects map[string]*projectRecord `json:"projects"`
+	Clusters map[string]*clusterRecord `json:"clusters"`
+}
+
+// loadJournal load journal from path, nothing will be written if readOnly is true
+func loadJournal(path string, readOnly bool) (*journal, error) {
+	if path == "" {
+		path = defaultJournalPath
+	}
+	j := &journal{
+		path:     path,
+		readOnly: readOnly,
+		Projects: make(map[string]*projectRecord, 0),
+		Clusters: make(map[string]*clusterRecord, 0),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			blog.Infof("journal %s not found, starting a new migration", path)
+			return j, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	blog.Infof("loaded journal %s with %d projects and %d clusters", path, len(j.Projects), len(j.Clusters))
+
+	return j, nil
+}
+
+// projectDone check whether step of project is done
+func (j *journal) projectDone(projectID, step string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	record, ok := j.Projects[projectID]
+	if !ok {
+		return false
+	}
+	_, ok = record.Steps[step]
+	return ok
+}
+
+// markProject record step of project as done, errMsg is recorded if step failed
+func (j *journal) markProject(projectID, name, step, errMsg string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	record, ok := j.Projects[projectID]
+	if !ok {
+		record = &projectRecord{ProjectID: projectID, Name: name, Steps: make(map[string]string, 0)}
+		j.Projects[projectID] = record
+	}
+	record.LastError = options.Redact(errMsg)
+	if errMsg == "" {
+		record.Steps[step] = time.Now().Format(time.RFC3339)
+	}
+	j.save()
+}
+
+// getCluster get a copy of cluster record, nil if cluster is not in journal
+func (j *journal) getCluster(originClusterID string) *clusterRecord {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.getClusterLocked(originClusterID)
+}
+
+func (j *journal) getClusterLocked(originClusterID string) *clusterRecord {
+	record, ok := j.Clusters[originClusterID]
+	if !ok {
+		return nil
+	}
+	r := *record
+	r.Steps = make(map[string]string, len(record.Steps))
+	for k, v := range record.Steps {
+		r.Steps[k] = v
+	}
+	return &r
+}
+
+// clusterDone check whether step of cluster is done
+func (j *journal) clusterDone(originClusterID, step string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	record, ok := j.Clusters[originClusterID]
+	if !ok {
+		return false
+	}
+	_, ok = record.Steps[step]
+	return ok
+}
+
+// markCluster record step of cluster as done, errMsg is recorded if step failed
+func (j *journal) markCluster(originClusterID, clusterID, projectID, name, step, errMsg string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	record, ok := j.Clusters[originClusterID]
+	if !ok {
+		record = &clusterRecord{
+			OriginClusterID: originClusterID,
+			ProjectID:       projectID,
+			ClusterName:     name,
+			Steps:           make(map[string]string, 0),
+		}
+		j.Clusters[originClusterID] = record
+	}
+	record.ClusterID = clusterID
+	record.LastError = options.Redact(errMsg)
+	if errMsg == "" {
+		record.Steps[step] = time.Now().Format(time.RFC3339)
+	}
+	j.save()
+}
+
+// projects get a copy of all project records
+func (j *journal) projects() []projectRecord {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	records := make([]projectRecord, 0, len(j.Projects))
+	for _, record := range j.Projects {
+		r := *record
+		r.Steps = make(map[string]string, len(record.Steps))
+		for k, v := range record.Steps {
+			r.Steps[k] = v
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// clusters get a copy of all cluster records
+func (j *journal) clusters() []clusterRecord {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	records := make([]clusterRecord, 0, len(j.Clusters))
+	for originClusterID := range j.Clusters {
+		records = append(records, *j.getClusterLocked(originClusterID))
+	}
+	return records
+}
+
+// unmarkCluster forget steps of cluster which are undone by rollback
+func (j *journal) unmarkCluster(originClusterID string, steps ...string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	record, ok := j.Clusters[originClusterID]
+	if !ok {
+		return
+	}
+	for _, step := range steps {
+		delete(record.Steps, step)
+	}
+	j.save()
+}
+
+// resetProject forget all steps of project
+func (j *journal) resetProject(projectID string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	delete(j.Projects, projectID)
+	j.save()
+}
+
+// resetCluster forget all steps of cluster, it will be migrated from scratch
+func (j *journal) resetCluster(originClusterID string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	delete(j.Clusters, originClusterID)
+	j.save()
+}
+
+// save write journal to a temporary file and rename it, so that the journal is never half written
+func (j *journal) save() {
+	if j.readOnly {
+		return
+	}
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		blog.Errorf("marshal journal failed, %v", err)
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(j.path), "."+filepath.Base(j.path)+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		blog.Errorf("write journal %s failed, %v", tmp, err)
+		return
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		blog.Errorf("rename journal %s failed, %v", j.path, err)
+	}
+}
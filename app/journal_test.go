@@ -0,0 +1,167 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j, err := loadJournal(path, false)
+	if err != nil {
+		t.Fatalf("load missing journal failed, %v", err)
+	}
+	if len(j.projects()) != 0 || len(j.clusters()) != 0 {
+		t.Fatalf("new journal is not empty")
+	}
+
+	j.markProject("p1", "project", stepProjectCreated, "")
+	j.markCluster("BCS-K8S-15000", "BCS-K8S-40001", "p1", "c1", stepClusterIDAllocated, "")
+	j.markCluster("BCS-K8S-15000", "BCS-K8S-40001", "p1", "c1", stepClusterInserted, "")
+	j.markCluster("BCS-K8S-15000", "BCS-K8S-40001", "p1", "c1", stepClusterSyncedToCc, "bcs cc unavailable")
+	j.markCluster("BCS-K8S-15001", "BCS-K8S-15001", "p1", "c2", stepClusterInserted, "")
+
+	j, err = loadJournal(path, false)
+	if err != nil {
+		t.Fatalf("reload journal failed, %v", err)
+	}
+	if !j.projectDone("p1", stepProjectCreated) || j.projectDone("p1", stepProjectExisted) {
+		t.Errorf("project steps not persisted: %+v", j.projects())
+	}
+	record := j.getCluster("BCS-K8S-15000")
+	if record == nil {
+		t.Fatal("cluster BCS-K8S-15000 not persisted")
+	}
+	if record.ClusterID != "BCS-K8S-40001" || record.LastError != "bcs cc unavailable" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	for step, want := range map[string]bool{stepClusterIDAllocated: true, stepClusterInserted: true,
+		stepClusterSyncedToCc: false} {
+		if got := j.clusterDone("BCS-K8S-15000", step); got != want {
+			t.Errorf("step %s done %v, want %v", step, got, want)
+		}
+	}
+
+	// records returned are copies
+	record.Steps[stepAgentDeployed] = "now"
+	if j.clusterDone("BCS-K8S-15000", stepAgentDeployed) {
+		t.Error("journal changed through a copy of record")
+	}
+
+	j.unmarkCluster("BCS-K8S-15000", stepClusterInserted)
+	if j.clusterDone("BCS-K8S-15000", stepClusterInserted) {
+		t.Error("step not unmarked")
+	}
+	j.resetCluster("BCS-K8S-15001")
+	j.resetProject("p1")
+	j, _ = loadJournal(path, false)
+	if len(j.clusters()) != 1 || len(j.projects()) != 0 {
+		t.Errorf("reset not persisted: %d clusters, %d projects", len(j.clusters()), len(j.projects()))
+	}
+}
+
+func TestJournalReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j, err := loadJournal(path, true)
+	if err != nil {
+		t.Fatalf("load journal failed, %v", err)
+	}
+	j.markCluster("BCS-K8S-15000", "BCS-K8S-15000", "p1", "c1", stepClusterInserted, "")
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("read only journal is written, %v", err)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadJournal(path, true); err == nil {
+		t.Error("corrupted journal is loaded")
+	}
+}
+
+func TestResumeCluster(t *testing.T) {
+	c := types.Cluster{ClusterID: "BCS-K8S-15000", ProjectID: "p1", Name: "c1"}
+	tests := []struct {
+		name      string
+		imported  *types.ClusterM
+		clusterID string
+		steps     []string
+		// want clusterID of the resumed cluster, empty if it is migrated again
+		want      string
+		wantReset bool
+	}{
+		{"nothing allocated", nil, "", nil, "", false},
+		{"renumbered and inserted", &types.ClusterM{ClusterID: "BCS-K8S-40001", ProjectID: "p1",
+			ClusterName: "c1"}, "BCS-K8S-40001", []string{stepClusterIDAllocated, stepClusterInserted},
+			"BCS-K8S-40001", false},
+		{"stopped right after insert", &types.ClusterM{ClusterID: "BCS-K8S-15000", ProjectID: "p1",
+			ClusterName: "c1"}, "BCS-K8S-15000", []string{stepClusterIDAllocated}, "BCS-K8S-15000", false},
+		{"inserted but deleted since", nil, "BCS-K8S-40001", []string{stepClusterInserted}, "", true},
+		{"clusterID taken by another cluster", &types.ClusterM{ClusterID: "BCS-K8S-40001", ProjectID: "p1",
+			ClusterName: "other"}, "BCS-K8S-40001", []string{stepClusterInserted}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, err := loadJournal(filepath.Join(t.TempDir(), "journal.json"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.steps {
+				j.markCluster(c.ClusterID, tt.clusterID, c.ProjectID, c.Name, step, "")
+			}
+			app := &App{op: &options.UpgradeOption{}, journal: j, report: newReport(CommandMigrate, false)}
+			snapshot := newClusterSnapshot()
+			if tt.imported != nil {
+				snapshot.add(*tt.imported)
+			}
+			record := &clusterRecord{ClusterID: tt.clusterID}
+			if r := j.getCluster(c.ClusterID); r != nil {
+				record = r
+			}
+			changed := newClusterIDMapping()
+
+			resumed, err := app.resumeCluster(context.Background(), c, record, snapshot, changed)
+			if err != nil {
+				t.Fatalf("resume failed, %v", err)
+			}
+			got := ""
+			if resumed != nil {
+				got = resumed.ClusterID
+			}
+			if got != tt.want {
+				t.Fatalf("resumed as %q, want %q", got, tt.want)
+			}
+			if tt.wantReset && j.getCluster(c.ClusterID) != nil {
+				t.Error("journal of cluster not reset")
+			}
+			if got == "" {
+				return
+			}
+			if !j.clusterDone(c.ClusterID, stepClusterInserted) {
+				t.Error("resumed cluster not marked as inserted")
+			}
+			if changed.origin(got) != c.ClusterID {
+				t.Errorf("origin of %s is %s, want %s", got, changed.origin(got), c.ClusterID)
+			}
+		})
+	}
+}
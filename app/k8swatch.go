@@ -0,0 +1,140 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+const oldK8SWatchName = "bcs-k8s-watch"
+
+// env of the new bcs k8s watch rendered by migrate tool, see k8s-watch-deployment.yaml
+const (
+	envWatchClusterID = "clusterId"
+	envWatchStorage   = "customStorage"
+	envWatchGateway   = "bcsApiGateway"
+	envWatchToken     = "bcsApiGatewayToken"
+)
+
+// deployK8SWatch deploy the second bcs k8s watch and its cert secret in cluster through bcs api in 1.18
+func (app *App) deployK8SWatch(ctx context.Context, cluster types.ClusterM, changeClusters *clusterIDMapping) error {
+	originClusterID := changeClusters.origin(cluster.ClusterID)
+	op := app.clusterOption(originClusterID)
+	blog.Infof("deploying new k8s watch for %s[%s]", cluster.ClusterName, cluster.ClusterID)
+	fail := func(err error) error {
+		app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+			stepWatchDeployed, err.Error())
+		return err
+	}
+
+	clientset, err := generateClientset(ctx, op, cluster, originClusterID)
+	if err != nil {
+		return fail(err)
+	}
+
+	// the secret is shared with kube agent if they are in the same namespace
+	secret, err := getCertSecret(ctx, op, op.K8SWatch.Namespace)
+	if err != nil {
+		return fail(err)
+	}
+
+	deployment, err := renderK8SWatch(ctx, op, clientset, cluster.ClusterID)
+	if err != nil {
+		return fail(err)
+	}
+
+	err = app.applyComponent(ctx, clientset, cluster, originClusterID, secret, deployment,
+		stepWatchSecretCreated, stepWatchDeployed)
+	if err != nil || op.DryRun {
+		return err
+	}
+
+	err = waitForRollout(ctx, op, clientset, deployment.Namespace, deployment.Name)
+	app.markCluster(originClusterID, cluster.ClusterID, cluster.ProjectID, cluster.ClusterName,
+		stepWatchReady, errString(err))
+	if err != nil {
+		return err
+	}
+
+	blog.Infof("deploy new k8s watch for %s[%s] success", cluster.ClusterName, cluster.ClusterID)
+
+	return nil
+}
+
+// renderK8SWatch render the new bcs k8s watch Deployment for cluster, image repository and service account
+// are taken from the old bcs k8s watch, the service account in yaml_path is kept if the old one has none
+func renderK8SWatch(ctx context.Context, op *options.UpgradeOption, clientset *kubernetes.Clientset,
+	clusterID string) (*v1.Deployment, error) {
+	if op.K8SWatch.StorageAddr == "" {
+		return nil, fmt.Errorf("empty k8s_watch.storage_addr")
+	}
+	imageRepo, serviceAccount, err := oldImageRepo(ctx, op, clientset, clusterID,
+		oldComponent{name: oldK8SWatchName, namespace: op.K8SWatch.Namespace}, op.K8SWatch.ImageRepo,
+		op.K8SWatch.ServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := op.K8SWatch.GatewayAddr
+	if gateway == "" {
+		gateway = op.BCSApiGateway.Addr
+	}
+
+	deployment, err := loadDeployment(op.K8SWatch.YamlPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(deployment.Spec.Template.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("no containers in deployment %s", op.K8SWatch.YamlPath)
+	}
+	deployment.Namespace = op.K8SWatch.Namespace
+	container := &deployment.Spec.Template.Spec.Containers[0]
+	container.Image = imageRepo + op.K8SWatch.Image
+	setEnv(container, envWatchClusterID, clusterID)
+	setEnv(container, envWatchStorage, op.K8SWatch.StorageAddr)
+	setEnv(container, envWatchGateway, gateway)
+	setEnv(container, envWatchToken, op.BCSApiGateway.Token)
+	if serviceAccount != "" {
+		deployment.Spec.Template.Spec.ServiceAccountName = serviceAccount
+		deployment.Spec.Template.Spec.DeprecatedServiceAccount = serviceAccount
+	}
+	for k := range deployment.Spec.Template.Spec.Volumes {
+		volume := &deployment.Spec.Template.Spec.Volumes[k]
+		if volume.Name == bcsCertsVolume && volume.Secret != nil {
+			volume.Secret.SecretName = op.BCSCertName
+		}
+	}
+
+	return deployment, nil
+}
+
+// setEnv set env of container, the env is appended if not found
+func setEnv(container *corev1.Container, name, value string) {
+	for i := range container.Env {
+		if container.Env[i].Name == name {
+			container.Env[i].Value = value
+			return
+		}
+	}
+	container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: value})
+}
@@ -0,0 +1,148 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+)
+
+// collections of the tool in mongoDB, cluster manager does not read them
+const (
+	mongoDBCollectionNameLock    = "bcs_upgradetool_lock"
+	mongoDBCollectionNameCounter = "bcs_upgradetool_counter"
+)
+
+const (
+	runLockID           = "upgradetool"
+	clusterNumCounterID = "cluster_num"
+	// the lock expires if it is not renewed within runLockTTL, e.g. the run is killed
+	runLockTTL       = 60 * time.Second
+	runLockHeartbeat = runLockTTL / 3
+)
+
+// runLock lease of a mutating run in mongoDB, only one of migrate, rollback, cleanup and restore can hold it
+type runLock struct {
+	Owner      string    `bson:"owner"`
+	Command    string    `bson:"command"`
+	AcquiredAt time.Time `bson:"acquiredAt"`
+	Heartbeat  time.Time `bson:"heartbeat"`
+	ExpireAt   time.Time `bson:"expireAt"`
+}
+
+// lockOwner user, host and pid of this run
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s/%d", os.Getenv("USER"), host, os.Getpid())
+}
+
+// lockRun take the run lock and renew it by heartbeat until unlock is called, the returned context is
+// cancelled if the lock is lost. Dry run does not take the lock
+func (app *App) lockRun(ctx context.Context) (context.Context, func(), error) {
+	if app.op.DryRun {
+		return ctx, func() {}, nil
+	}
+
+	if app.op.ForceUnlock {
+		old, err := app.store.removeLock(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("force unlock failed, %v", err)
+		}
+		if old != nil {
+			blog.Warnf("force unlocked %s held by %s since %s", old.Command, old.Owner,
+				old.AcquiredAt.Format(time.RFC3339))
+		}
+	}
+
+	owner := lockOwner()
+	now := time.Now()
+	holder, err := app.store.takeLock(ctx, runLock{
+		Owner:      owner,
+		Command:    app.report.Command,
+		AcquiredAt: now,
+		Heartbeat:  now,
+		ExpireAt:   now.Add(runLockTTL),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("take run lock failed, %v", err)
+	}
+	if holder != nil {
+		return nil, nil, fmt.Errorf("run lock is held by %s running %s since %s until %s, wait for it or "+
+			"run with --force-unlock if it is dead", holder.Owner, holder.Command,
+			holder.AcquiredAt.Format(time.RFC3339), holder.ExpireAt.Format(time.RFC3339))
+	}
+	blog.Infof("took run lock as %s", owner)
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(runLockHeartbeat)
+		defer ticker.Stop()
+		renewed := now
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			held, err := app.store.renewLock(lockCtx, owner, now)
+			switch {
+			case err != nil && now.Sub(renewed) < runLockTTL:
+				blog.Warnf("renew run lock failed, %v", err)
+			case err != nil:
+				blog.Errorf("run lock expired, renew run lock failed, %v", err)
+				cancel()
+				return
+			case !held:
+				blog.Errorf("run lock was taken by another run, stopping")
+				cancel()
+				return
+			default:
+				renewed = now
+			}
+		}
+	}()
+
+	unlock := func() {
+		cancel()
+		<-done
+		if err := app.store.releaseLock(context.Background(), owner); err != nil {
+			blog.Errorf("release run lock failed, %v", err)
+			return
+		}
+		blog.Infof("released run lock")
+	}
+	return lockCtx, unlock, nil
+}
+
+// allocateClusterNum allocate a cluster number with the counter document in mongoDB, so that concurrent runs
+// never get the same one. The counter is raised to the clusterIDs in snapshot, those in cluster manager and
+// bk_bcs_cc, first. Dry run and runs not migrating cluster data allocate from snapshot only
+func (app *App) allocateClusterNum(ctx context.Context, snapshot *clusterSnapshot) (int, error) {
+	if app.op.DryRun || !app.op.MigrateClusterData {
+		return snapshot.allocateClusterNum(), nil
+	}
+
+	num, err := app.store.nextClusterNum(ctx, snapshot.maxClusterNum())
+	if err != nil {
+		return 0, fmt.Errorf("allocate cluster number from counter failed, %v", err)
+	}
+	return num, nil
+}
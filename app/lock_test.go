@@ -0,0 +1,113 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+func TestLockRun(t *testing.T) {
+	now := time.Now()
+	other := &runLock{Owner: "other", Command: CommandCleanup, AcquiredAt: now, ExpireAt: now.Add(runLockTTL)}
+	expired := &runLock{Owner: "other", Command: CommandCleanup, AcquiredAt: now.Add(-2 * runLockTTL),
+		ExpireAt: now.Add(-runLockTTL)}
+
+	tests := []struct {
+		name        string
+		held        *runLock
+		dryRun      bool
+		forceUnlock bool
+		wantErr     bool
+		wantLocked  bool
+	}{
+		{"free", nil, false, false, false, true},
+		{"held by another run", other, false, false, true, true},
+		{"expired", expired, false, false, false, true},
+		{"force unlock", other, false, true, false, true},
+		{"dry run does not lock", other, true, false, false, true},
+		{"dry run on free lock", nil, true, false, false, false},
+	}
+	for _, tt := range tests {
+		store := newMemStore()
+		store.runLock = tt.held
+		app := &App{
+			op:     &options.UpgradeOption{DryRun: tt.dryRun, ForceUnlock: tt.forceUnlock},
+			store:  store,
+			report: newReport(CommandMigrate, tt.dryRun),
+		}
+		ctx, unlock, err := app.lockRun(context.Background())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if store.locked() != tt.wantLocked {
+			t.Errorf("%s: locked %v, want %v", tt.name, store.locked(), tt.wantLocked)
+		}
+		if err != nil {
+			continue
+		}
+		unlock()
+		if !tt.dryRun && store.locked() {
+			t.Errorf("%s: lock is not released", tt.name)
+		}
+		if !tt.dryRun && ctx.Err() == nil {
+			t.Errorf("%s: lock context is not cancelled on unlock", tt.name)
+		}
+	}
+}
+
+func TestAllocateClusterNumFromCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      options.UpgradeOption
+		counter int
+		want    []int
+	}{
+		{"counter behind snapshot", options.UpgradeOption{MigrateClusterData: true}, 0,
+			[]int{40006, 40007}},
+		{"counter ahead of snapshot", options.UpgradeOption{MigrateClusterData: true}, 40100,
+			[]int{40101, 40102}},
+		{"dry run allocates from snapshot", options.UpgradeOption{MigrateClusterData: true, DryRun: true},
+			40100, []int{40006, 40007}},
+		{"no cluster data allocates from snapshot", options.UpgradeOption{}, 40100, []int{40006, 40007}},
+	}
+	for _, tt := range tests {
+		store := newMemStore()
+		store.clusterNum = tt.counter
+		op := tt.op
+		app := &App{op: &op, store: store}
+		snapshot := newClusterSnapshot()
+		snapshot.add(types.ClusterM{ClusterID: "BCS-K8S-40005"})
+
+		var got []int
+		for range tt.want {
+			num, err := app.allocateClusterNum(context.Background(), snapshot)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got = append(got, num)
+		}
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,530 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// objects in manifest are applied in this order and removed in reverse order
+var manifestOrder = []string{"ServiceAccount", "ClusterRole", "Role", "ClusterRoleBinding", "RoleBinding",
+	"ConfigMap", "Secret", "Deployment"}
+
+// objects created from manifest carry this label, rollback only removes objects with it and objects
+// existed before are never updated
+const (
+	managedByLabel       = "app.kubernetes.io/managed-by"
+	managedByUpgradeTool = "bcs-upgradetool"
+)
+
+// manifest objects in a multi-document yaml file, the Deployment is kept apart as it is rendered and
+// checked for rollout separately
+type manifest struct {
+	deployment *appsv1.Deployment
+	// objects other than the Deployment in manifestOrder
+	objects []runtime.Object
+}
+
+// manifestVars variables of manifest templates
+type manifestVars struct {
+	// ClusterID clusterID in cluster manager, OriginClusterID clusterID in 1.18
+	ClusterID       string
+	OriginClusterID string
+	ProjectID       string
+	// GatewayHost host of bcs api gateway without scheme
+	GatewayHost string
+	// ImageRepo image repository of the old bcs kube agent ending with /, Image is kube_agent.image
+	ImageRepo      string
+	Image          string
+	CertSecretName string
+	Namespace      string
+	// Values kube_agent.values overridden by kube_agent.cluster_values of the cluster, options of clusterOption
+	// have them merged already together with kube_agent_values in overrides
+	Values map[string]string
+}
+
+// newManifestVars variables of cluster, ImageRepo is only known after the old bcs kube agent is found
+func newManifestVars(op *options.UpgradeOption, cluster types.ClusterM, originClusterID string) *manifestVars {
+	vars := &manifestVars{
+		ClusterID:       cluster.ClusterID,
+		OriginClusterID: originClusterID,
+		ProjectID:       cluster.ProjectID,
+		Image:           op.KubeAgent.Image,
+		CertSecretName:  op.BCSCertName,
+		Namespace:       op.KubeAgent.Namespace,
+		Values:          make(map[string]string, 0),
+	}
+	if gAddr := strings.Split(op.BCSApiGateway.Addr, "//"); len(gAddr) == 2 {
+		vars.GatewayHost = gAddr[1]
+	}
+	for k, v := range op.KubeAgent.Values {
+		vars.Values[k] = v
+	}
+	for k, v := range op.KubeAgent.ClusterValues[originClusterID] {
+		vars.Values[k] = v
+	}
+	return vars
+}
+
+// manifestFuncs functions of manifest templates besides the builtin ones
+var manifestFuncs = template.FuncMap{
+	// default value if it is empty, e.g. {{ .Values.cpu | default "500m" }}
+	"default": func(def, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// loadManifest load a yaml file with exactly one Deployment and any number of ServiceAccount, ClusterRole,
+// Role, ClusterRoleBinding, RoleBinding, ConfigMap or Secret, the file is rendered as go template with vars
+// first, missing Values are empty
+func loadManifest(path string, vars *manifestVars) (*manifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(manifestFuncs).Option("missingkey=zero").
+		Parse(string(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parse manifest %s failed, %v", path, err)
+	}
+	buf := &bytes.Buffer{}
+	if err = tmpl.Execute(buf, vars); err != nil {
+		return nil, fmt.Errorf("render manifest %s failed, %v", path, err)
+	}
+	data := buf.Bytes()
+
+	m := &manifest{objects: make([]runtime.Object, 0)}
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read manifest %s failed, %v", path, err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(doc, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decode manifest %s failed, %v", path, err)
+		}
+		if manifestIndex(gvk.Kind) == len(manifestOrder) {
+			return nil, fmt.Errorf("unsupported kind %s in manifest %s", gvk.Kind, path)
+		}
+		if deployment, ok := obj.(*appsv1.Deployment); ok {
+			if m.deployment != nil {
+				return nil, fmt.Errorf("more than one deployment in manifest %s", path)
+			}
+			m.deployment = deployment
+			continue
+		}
+		m.objects = append(m.objects, obj)
+	}
+	if m.deployment == nil {
+		return nil, fmt.Errorf("no deployment in manifest %s", path)
+	}
+	if len(m.deployment.Spec.Template.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("no containers in deployment of manifest %s", path)
+	}
+	sort.SliceStable(m.objects, func(i, j int) bool {
+		return manifestIndex(kindOf(m.objects[i])) < manifestIndex(kindOf(m.objects[j]))
+	})
+
+	return m, nil
+}
+
+func manifestIndex(kind string) int {
+	for i, k := range manifestOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(manifestOrder)
+}
+
+func kindOf(obj runtime.Object) string {
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil || len(gvks) == 0 {
+		return ""
+	}
+	return gvks[0].Kind
+}
+
+func describeObject(obj runtime.Object) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return kindOf(obj)
+	}
+	if accessor.GetNamespace() == "" {
+		return kindOf(obj) + " " + accessor.GetName()
+	}
+	return kindOf(obj) + " " + accessor.GetNamespace() + "/" + accessor.GetName()
+}
+
+// renderObjects put namespaced objects and service account subjects into namespace and label them as
+// managed by upgrade tool
+func (m *manifest) renderObjects(namespace string) error {
+	serviceAccounts := make(map[string]bool, 0)
+	for _, obj := range m.objects {
+		if sa, ok := obj.(*corev1.ServiceAccount); ok {
+			serviceAccounts[sa.Name] = true
+		}
+	}
+	renderSubjects := func(subjects []rbacv1.Subject) {
+		for i := range subjects {
+			if subjects[i].Kind == rbacv1.ServiceAccountKind &&
+				(subjects[i].Namespace == "" || serviceAccounts[subjects[i].Name]) {
+				subjects[i].Namespace = namespace
+			}
+		}
+	}
+
+	for _, obj := range m.objects {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		labels := accessor.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string, 0)
+		}
+		labels[managedByLabel] = managedByUpgradeTool
+		accessor.SetLabels(labels)
+
+		switch o := obj.(type) {
+		case *rbacv1.ClusterRole:
+			// cluster scoped
+		case *rbacv1.ClusterRoleBinding:
+			renderSubjects(o.Subjects)
+		case *rbacv1.RoleBinding:
+			o.Namespace = namespace
+			renderSubjects(o.Subjects)
+		case *corev1.Secret:
+			// apiserver only returns data, stringData is merged so that it can be compared
+			o.Namespace = namespace
+			for k, v := range o.StringData {
+				if o.Data == nil {
+					o.Data = make(map[string][]byte, 0)
+				}
+				o.Data[k] = []byte(v)
+			}
+			o.StringData = nil
+		default:
+			accessor.SetNamespace(namespace)
+		}
+	}
+	return nil
+}
+
+// applyObject create object in manifest, or update it if it differs and is managed by upgrade tool,
+// values of ConfigMap and Secret are never in diff
+func applyObject(ctx context.Context, clientset kubernetes.Interface, obj runtime.Object,
+	dryRun bool) (string, []string, error) {
+	get := metav1.GetOptions{}
+	create := metav1.CreateOptions{}
+	update := metav1.UpdateOptions{}
+	switch o := obj.(type) {
+	case *corev1.ServiceAccount:
+		client := clientset.CoreV1().ServiceAccounts(o.Namespace)
+		_, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		// tokens of service account are managed by kubernetes
+		return applyUnchanged, nil, err
+	case *rbacv1.ClusterRole:
+		client := clientset.RbacV1().ClusterRoles()
+		existing, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return updateObject(existing, diffRules(existing.Rules, o.Rules), dryRun, func() error {
+			existing.Rules = o.Rules
+			_, err := client.Update(ctx, existing, update)
+			return err
+		})
+	case *rbacv1.Role:
+		client := clientset.RbacV1().Roles(o.Namespace)
+		existing, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return updateObject(existing, diffRules(existing.Rules, o.Rules), dryRun, func() error {
+			existing.Rules = o.Rules
+			_, err := client.Update(ctx, existing, update)
+			return err
+		})
+	case *rbacv1.ClusterRoleBinding:
+		client := clientset.RbacV1().ClusterRoleBindings()
+		existing, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		diff := diffBinding(existing.RoleRef, o.RoleRef, existing.Subjects, o.Subjects)
+		return updateObject(existing, diff, dryRun, func() error {
+			// roleRef is immutable, binding is recreated
+			if existing.RoleRef != o.RoleRef {
+				if err := client.Delete(ctx, o.Name, metav1.DeleteOptions{}); err != nil {
+					return err
+				}
+				_, err := client.Create(ctx, o, create)
+				return err
+			}
+			existing.Subjects = o.Subjects
+			_, err := client.Update(ctx, existing, update)
+			return err
+		})
+	case *rbacv1.RoleBinding:
+		client := clientset.RbacV1().RoleBindings(o.Namespace)
+		existing, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		diff := diffBinding(existing.RoleRef, o.RoleRef, existing.Subjects, o.Subjects)
+		return updateObject(existing, diff, dryRun, func() error {
+			if existing.RoleRef != o.RoleRef {
+				if err := client.Delete(ctx, o.Name, metav1.DeleteOptions{}); err != nil {
+					return err
+				}
+				_, err := client.Create(ctx, o, create)
+				return err
+			}
+			existing.Subjects = o.Subjects
+			_, err := client.Update(ctx, existing, update)
+			return err
+		})
+	case *corev1.ConfigMap:
+		client := clientset.CoreV1().ConfigMaps(o.Namespace)
+		existing, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		diff := diffData(stringData(existing.Data, existing.BinaryData), stringData(o.Data, o.BinaryData))
+		return updateObject(existing, diff, dryRun, func() error {
+			existing.Data = o.Data
+			existing.BinaryData = o.BinaryData
+			_, err := client.Update(ctx, existing, update)
+			return err
+		})
+	case *corev1.Secret:
+		client := clientset.CoreV1().Secrets(o.Namespace)
+		existing, err := client.Get(ctx, o.Name, get)
+		if errors.IsNotFound(err) {
+			return createObject(dryRun, func() error {
+				_, err := client.Create(ctx, o, create)
+				return err
+			})
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return updateObject(existing, diffSecret(existing, o), dryRun, func() error {
+			existing.Type = o.Type
+			existing.Data = o.Data
+			existing.StringData = o.StringData
+			_, err := client.Update(ctx, existing, update)
+			return err
+		})
+	default:
+		return "", nil, fmt.Errorf("unsupported object %T", obj)
+	}
+}
+
+func createObject(dryRun bool, create func() error) (string, []string, error) {
+	if dryRun {
+		return applyCreated, nil, nil
+	}
+	return applyCreated, nil, create()
+}
+
+// updateObject update object if diff is not empty, objects not created by upgrade tool are never updated and
+// fail the apply if they differ
+func updateObject(existing metav1.Object, diff []string, dryRun bool, update func() error) (string, []string,
+	error) {
+	if len(diff) == 0 {
+		return applyUnchanged, nil, nil
+	}
+	if existing.GetLabels()[managedByLabel] != managedByUpgradeTool {
+		return "", nil, fmt.Errorf("%s/%s is not created by upgrade tool and differs from manifest: %s",
+			existing.GetNamespace(), existing.GetName(), strings.Join(diff, "; "))
+	}
+	if dryRun {
+		return applyUpdated, diff, nil
+	}
+	return applyUpdated, diff, update()
+}
+
+func diffRules(existing, desired []rbacv1.PolicyRule) []string {
+	if len(existing) == 0 && len(desired) == 0 || reflect.DeepEqual(existing, desired) {
+		return nil
+	}
+	return []string{fmt.Sprintf("~ rules %d -> %d", len(existing), len(desired))}
+}
+
+func diffBinding(existingRef, desiredRef rbacv1.RoleRef, existing, desired []rbacv1.Subject) []string {
+	diff := make([]string, 0)
+	if existingRef != desiredRef {
+		diff = append(diff, fmt.Sprintf("~ roleRef %s/%s -> %s/%s", existingRef.Kind, existingRef.Name,
+			desiredRef.Kind, desiredRef.Name))
+	}
+	if !(len(existing) == 0 && len(desired) == 0) && !reflect.DeepEqual(existing, desired) {
+		diff = append(diff, fmt.Sprintf("~ subjects %v -> %v", existing, desired))
+	}
+	return diff
+}
+
+func stringData(data map[string]string, binaryData map[string][]byte) map[string][]byte {
+	result := make(map[string][]byte, len(data)+len(binaryData))
+	for k, v := range data {
+		result[k] = []byte(v)
+	}
+	for k, v := range binaryData {
+		result[k] = v
+	}
+	return result
+}
+
+// removeObjects delete objects in manifest in reverse order, objects not created by upgrade tool are kept
+func removeObjects(ctx context.Context, clientset kubernetes.Interface, objects []runtime.Object) error {
+	for i := len(objects) - 1; i >= 0; i-- {
+		obj := objects[i]
+		existing, err := getObject(ctx, clientset, obj)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if existing.GetLabels()[managedByLabel] != managedByUpgradeTool {
+			blog.Infof("%s is not created by upgrade tool, keeping it", describeObject(obj))
+			continue
+		}
+		if err = deleteManifestObject(ctx, clientset, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		blog.Infof("delete %s", describeObject(obj))
+	}
+	return nil
+}
+
+func getObject(ctx context.Context, clientset kubernetes.Interface, obj runtime.Object) (metav1.Object, error) {
+	opts := metav1.GetOptions{}
+	switch o := obj.(type) {
+	case *corev1.ServiceAccount:
+		return clientset.CoreV1().ServiceAccounts(o.Namespace).Get(ctx, o.Name, opts)
+	case *rbacv1.ClusterRole:
+		return clientset.RbacV1().ClusterRoles().Get(ctx, o.Name, opts)
+	case *rbacv1.Role:
+		return clientset.RbacV1().Roles(o.Namespace).Get(ctx, o.Name, opts)
+	case *rbacv1.ClusterRoleBinding:
+		return clientset.RbacV1().ClusterRoleBindings().Get(ctx, o.Name, opts)
+	case *rbacv1.RoleBinding:
+		return clientset.RbacV1().RoleBindings(o.Namespace).Get(ctx, o.Name, opts)
+	case *corev1.ConfigMap:
+		return clientset.CoreV1().ConfigMaps(o.Namespace).Get(ctx, o.Name, opts)
+	case *corev1.Secret:
+		return clientset.CoreV1().Secrets(o.Namespace).Get(ctx, o.Name, opts)
+	case *appsv1.Deployment:
+		return clientset.AppsV1().Deployments(o.Namespace).Get(ctx, o.Name, opts)
+	default:
+		return nil, fmt.Errorf("unsupported object %T", obj)
+	}
+}
+
+func deleteManifestObject(ctx context.Context, clientset kubernetes.Interface, obj runtime.Object) error {
+	opts := metav1.DeleteOptions{}
+	switch o := obj.(type) {
+	case *corev1.ServiceAccount:
+		return clientset.CoreV1().ServiceAccounts(o.Namespace).Delete(ctx, o.Name, opts)
+	case *rbacv1.ClusterRole:
+		return clientset.RbacV1().ClusterRoles().Delete(ctx, o.Name, opts)
+	case *rbacv1.Role:
+		return clientset.RbacV1().Roles(o.Namespace).Delete(ctx, o.Name, opts)
+	case *rbacv1.ClusterRoleBinding:
+		return clientset.RbacV1().ClusterRoleBindings().Delete(ctx, o.Name, opts)
+	case *rbacv1.RoleBinding:
+		return clientset.RbacV1().RoleBindings(o.Namespace).Delete(ctx, o.Name, opts)
+	case *corev1.ConfigMap:
+		return clientset.CoreV1().ConfigMaps(o.Namespace).Delete(ctx, o.Name, opts)
+	case *corev1.Secret:
+		return clientset.CoreV1().Secrets(o.Namespace).Delete(ctx, o.Name, opts)
+	case *appsv1.Deployment:
+		return clientset.AppsV1().Deployments(o.Namespace).Delete(ctx, o.Name, opts)
+	default:
+		return fmt.Errorf("unsupported object %T", obj)
+	}
+}
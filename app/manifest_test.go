@@ -0,0 +1,47 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		diff    []string
+		result  string
+		updated bool
+		wantErr bool
+	}{
+		{"managed unchanged", managed, nil, applyUnchanged, false, false},
+		{"managed changed", managed, []string{"~ rules 1 -> 2"}, applyUpdated, true, false},
+		{"foreign unchanged", nil, nil, applyUnchanged, false, false},
+		{"foreign changed", nil, []string{"~ rules 1 -> 2"}, "", false, true},
+	}
+	for _, tt := range tests {
+		updated := false
+		existing := &metav1.ObjectMeta{Name: "bcs-kube-agent", Labels: tt.labels}
+		result, _, err := updateObject(existing, tt.diff, false, func() error {
+			updated = true
+			return nil
+		})
+		if result != tt.result || updated != tt.updated || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %q updated %v err %v", tt.name, result, updated, err)
+		}
+	}
+}
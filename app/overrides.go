@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+// loadOverrides load overrides of clusters from overrides_path, forced clusterIDs must be valid and unique
+func loadOverrides(path string) (map[string]options.ClusterOverride, error) {
+	overrides := make(map[string]options.ClusterOverride, 0)
+	if path == "" {
+		return overrides, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("decode overrides %s failed, %v", path, err)
+	}
+
+	forced := make(map[string]string, 0)
+	for originClusterID, o := range overrides {
+		if o.ClusterID == "" {
+			continue
+		}
+		if _, ok := parseClusterNum(o.ClusterID); !ok {
+			return nil, fmt.Errorf("invalid cluster_id %s of cluster %s in overrides", o.ClusterID, originClusterID)
+		}
+		if other, ok := forced[o.ClusterID]; ok {
+			return nil, fmt.Errorf("cluster_id %s is set to both %s and %s in overrides", o.ClusterID, other,
+				originClusterID)
+		}
+		forced[o.ClusterID] = originClusterID
+	}
+	blog.Infof("loaded overrides of %d clusters from %s", len(overrides), path)
+
+	return overrides, nil
+}
+
+// override overrides of cluster, originClusterID is the clusterID in 1.18
+func (app *App) override(originClusterID string) options.ClusterOverride {
+	return app.overrides[originClusterID]
+}
+
+// clusterOption options of cluster with its overrides applied, the global options are not changed. Template
+// values of kube agent are merged into kube_agent.values, kube_agent_values in overrides take precedence over
+// kube_agent.cluster_values, which take precedence over kube_agent.values
+func (app *App) clusterOption(originClusterID string) *options.UpgradeOption {
+	o, ok := app.overrides[originClusterID]
+	clusterValues, hasValues := app.op.KubeAgent.ClusterValues[originClusterID]
+	if !ok && !hasValues {
+		return app.op
+	}
+	op := *app.op
+	values := make(map[string]string, 0)
+	for _, layer := range []map[string]string{app.op.KubeAgent.Values, clusterValues, o.KubeAgentValues} {
+		for k, v := range layer {
+			values[k] = v
+		}
+	}
+	op.KubeAgent.Values = values
+	op.KubeAgent.ClusterValues = nil
+	if o.KubeAgentNamespace != "" {
+		op.KubeAgent.Namespace = o.KubeAgentNamespace
+	}
+	if o.KubeAgentImage != "" {
+		op.KubeAgent.Image = o.KubeAgentImage
+	}
+	if o.GatewayIP != "" {
+		op.BCSApiGateway.IP = o.GatewayIP
+	}
+	return &op
+}
+
+func orDefault(value, def string) string {
+	if value != "" {
+		return value
+	}
+	return def
+}
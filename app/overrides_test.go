@@ -0,0 +1,58 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+func TestClusterOption(t *testing.T) {
+	op := &options.UpgradeOption{}
+	op.KubeAgent.Namespace = "bcs-nodes"
+	op.KubeAgent.Values = map[string]string{"cpu": "1", "memory": "1Gi", "replicas": "1"}
+	op.KubeAgent.ClusterValues = map[string]map[string]string{
+		"BCS-K8S-15000": {"cpu": "2", "memory": "2Gi"},
+		"BCS-K8S-15001": {"cpu": "2"},
+	}
+	app := &App{op: op, overrides: map[string]options.ClusterOverride{
+		"BCS-K8S-15000": {KubeAgentNamespace: "kube-system", KubeAgentValues: map[string]string{"cpu": "4"}},
+	}}
+
+	tests := []struct {
+		origin    string
+		namespace string
+		values    map[string]string
+	}{
+		{"BCS-K8S-15000", "kube-system", map[string]string{"cpu": "4", "memory": "2Gi", "replicas": "1"}},
+		{"BCS-K8S-15001", "bcs-nodes", map[string]string{"cpu": "2", "memory": "1Gi", "replicas": "1"}},
+		{"BCS-K8S-15002", "bcs-nodes", map[string]string{"cpu": "1", "memory": "1Gi", "replicas": "1"}},
+	}
+	for _, tt := range tests {
+		got := app.clusterOption(tt.origin)
+		if got.KubeAgent.Namespace != tt.namespace {
+			t.Errorf("%s: namespace %s, want %s", tt.origin, got.KubeAgent.Namespace, tt.namespace)
+		}
+		vars := newManifestVars(got, types.ClusterM{ClusterID: "BCS-K8S-40000"}, tt.origin)
+		if !reflect.DeepEqual(vars.Values, tt.values) {
+			t.Errorf("%s: values %v, want %v", tt.origin, vars.Values, tt.values)
+		}
+	}
+	if op.KubeAgent.Namespace != "bcs-nodes" || op.KubeAgent.Values["cpu"] != "1" {
+		t.Errorf("global options changed: %+v", op.KubeAgent)
+	}
+}
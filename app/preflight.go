@@ -0,0 +1,429 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"github.com/go-sql-driver/mysql"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// results of checks in preflight and simulate
+const (
+	checkPass = "PASS"
+	checkFail = "FAIL"
+	checkWarn = "WARN"
+	checkSkip = "SKIP"
+)
+
+// preflightTimeout timeout of each dial and registry request in preflight
+const preflightTimeout = 10 * time.Second
+
+// manifestMediaTypes media types of image manifests and manifest lists accepted from registries
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// errImageUnverified the registry is reachable but the image can not be checked without credentials
+var errImageUnverified = errors.New("registry requires credentials, image not verified")
+
+// challengeParam a parameter of a WWW-Authenticate challenge
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// checkResult result of a check in preflight or simulate, scope is the target or simulation mode checked
+type checkResult struct {
+	scope  string
+	name   string
+	status string
+	detail string
+}
+
+// newCheckResult passed check if err is nil, failed check otherwise
+func newCheckResult(scope, name string, err error) checkResult {
+	if err != nil {
+		return checkResult{scope: scope, name: name, status: checkFail, detail: err.Error()}
+	}
+	return checkResult{scope: scope, name: name, status: checkPass}
+}
+
+// printCheckResults print results as a table with scope as title of the first column, the number of failed
+// checks is returned
+func printCheckResults(out io.Writer, scope string, results []checkResult) int {
+	failed := 0
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tCHECK\tRESULT\tDETAIL\n", scope)
+	for _, r := range results {
+		if r.status == checkFail {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.scope, r.name, r.status,
+			options.Redact(strings.ReplaceAll(r.detail, "\n", " ")))
+	}
+	w.Flush()
+	return failed
+}
+
+// DoPreflight check endpoints are reachable, credentials work, the cert secret exists in the blueking cluster
+// and the image of the new bcs kube agent is in its registry, nothing is changed
+func (app *App) DoPreflight(ctx context.Context) error {
+	defer app.closeClients()
+	return app.runPreflight(ctx)
+}
+
+// runPreflight run checks and print them as a table, an error is returned if any check failed
+func (app *App) runPreflight(ctx context.Context) error {
+	results := app.preflight(ctx)
+	failed := printCheckResults(os.Stdout, "TARGET", results)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d preflight checks failed", failed, len(results))
+	}
+	blog.Infof("all %d preflight checks passed", len(results))
+	return nil
+}
+
+// preflight run all checks, checks of clusters use the first selected cluster
+func (app *App) preflight(ctx context.Context) []checkResult {
+	op := app.op
+	results := make([]checkResult, 0)
+	add := func(r checkResult) {
+		if r.status == checkFail {
+			blog.Errorf("preflight check %s of %s failed, %s", r.name, r.scope, r.detail)
+		}
+		results = append(results, r)
+	}
+
+	if app.discoverErr != nil {
+		add(newCheckResult("config", "discover values left empty", app.discoverErr))
+	}
+	for _, e := range preflightEndpoints(op) {
+		if e.err != nil {
+			add(newCheckResult(e.target, "dial", e.err))
+			continue
+		}
+		if e.addr == "" {
+			add(checkResult{scope: e.target, name: "dial", status: checkSkip, detail: "address not set"})
+			continue
+		}
+		add(newCheckResult(e.target, "dial "+e.addr, dial(ctx, e.addr)))
+	}
+
+	var clusters []types.Cluster
+	if app.sqlClient == nil {
+		add(newCheckResult("mysql", "connect and check schema", app.initMysqlClient()))
+	}
+	if app.sqlClient != nil {
+		var err error
+		clusters, err = app.listClusters(ctx)
+		r := newCheckResult("mysql", "select clusters", err)
+		if err == nil {
+			r.detail = fmt.Sprintf("%d clusters selected", len(clusters))
+		}
+		add(r)
+	}
+
+	if app.store == nil {
+		add(newCheckResult("mongoDB", "connect", app.initMongoClient()))
+	}
+	if app.store != nil {
+		add(newCheckResult("mongoDB", "ping", app.store.ping(ctx)))
+	}
+
+	app.initAPIClients()
+	_, err := app.bcsCc.GetAccessToken(ctx)
+	add(newCheckResult("bkssm", "get access token", err))
+
+	if op.BKClusterID == "" {
+		add(newCheckResult("bcs api gateway", "request blueking cluster", fmt.Errorf("bk_cluster_id not set")))
+	} else {
+		add(newCheckResult("bcs api gateway", "request blueking cluster "+op.BKClusterID,
+			checkClusterReachable(ctx, op, op.BKClusterID)))
+		if op.KubeAgent.Enable || op.K8SWatch.Enable {
+			_, err = getCertSecret(ctx, op, "")
+			add(newCheckResult("bcs api gateway", "get secret bcs-system/"+op.BCSCertName, err))
+		}
+	}
+
+	if len(clusters) == 0 {
+		add(checkResult{scope: "bcs api", name: "tunnel to cluster", status: checkSkip,
+			detail: "no clusters selected"})
+		return results
+	}
+	for _, r := range app.preflightCluster(ctx, clusters[0]) {
+		add(r)
+	}
+	return results
+}
+
+// preflightCluster check the tunnel of the old bcs api to cluster and the image of the new bcs kube agent
+// rendered for it
+func (app *App) preflightCluster(ctx context.Context, c types.Cluster) []checkResult {
+	op := app.clusterOption(c.ClusterID)
+	cluster := types.ClusterM{ClusterID: c.ClusterID, ClusterName: c.Name, ProjectID: c.ProjectID}
+	clientset, err := generateClientset(ctx, op, cluster, c.ClusterID)
+	if err == nil {
+		_, err = clientset.Discovery().ServerVersion()
+	}
+	results := []checkResult{newCheckResult("bcs api", "tunnel to cluster "+c.ClusterID, err)}
+	if err != nil || !op.KubeAgent.Enable {
+		return results
+	}
+
+	image, err := kubeAgentImage(ctx, op, clientset, cluster)
+	if err != nil {
+		return append(results, newCheckResult("registry", "render kube agent image", err))
+	}
+	err = checkImage(ctx, image)
+	r := newCheckResult("registry", "image "+image, err)
+	if errors.Is(err, errImageUnverified) {
+		r.status = checkWarn
+	}
+	return append(results, r)
+}
+
+// kubeAgentImage image of the new bcs kube agent rendered for cluster
+func kubeAgentImage(ctx context.Context, op *options.UpgradeOption, clientset *kubernetes.Clientset,
+	cluster types.ClusterM) (string, error) {
+	if kubeAgentByHelm(op) {
+		values, err := renderKubeAgentValues(ctx, op, clientset, cluster.ClusterID)
+		if err != nil {
+			return "", err
+		}
+		image, _ := values["image"].(map[string]interface{})
+		return fmt.Sprintf("%v:%v", image["repository"], image["tag"]), nil
+	}
+
+	m, err := renderKubeAgent(ctx, op, clientset, cluster, cluster.ClusterID)
+	if err != nil {
+		return "", err
+	}
+	return m.deployment.Spec.Template.Spec.Containers[0].Image, nil
+}
+
+// preflightEndpoint address to dial in preflight
+type preflightEndpoint struct {
+	target string
+	addr   string
+	err    error
+}
+
+// preflightEndpoints host:port of mysql, mongoDB, the old bcs api, bcs api gateway, bcs cc and bkssm
+func preflightEndpoints(op *options.UpgradeOption) []preflightEndpoint {
+	endpoints := make([]preflightEndpoint, 0)
+	if op.DSN != "" {
+		cfg, err := mysql.ParseDSN(op.DSN)
+		if err != nil {
+			endpoints = append(endpoints, preflightEndpoint{target: "mysql", err: err})
+		} else {
+			endpoints = append(endpoints, preflightEndpoint{target: "mysql", addr: cfg.Addr})
+		}
+	} else {
+		endpoints = append(endpoints, preflightEndpoint{target: "mysql"})
+	}
+	mongoAddr := ""
+	if op.MongoDB.Host != "" {
+		mongoAddr = net.JoinHostPort(op.MongoDB.Host, strconv.FormatUint(uint64(op.MongoDB.Port), 10))
+	}
+	endpoints = append(endpoints, preflightEndpoint{target: "mongoDB", addr: mongoAddr})
+
+	for _, e := range []struct{ target, addr string }{
+		{"bcs api", op.BCSApi.Addr},
+		{"bcs api gateway", op.BCSApiGateway.Addr},
+		{"bcs cc", op.BCSCc.Addr},
+		{"bkssm", op.BCSCc.SsmHost},
+	} {
+		addr, err := hostPort(e.addr)
+		endpoints = append(endpoints, preflightEndpoint{target: e.target, addr: addr, err: err})
+	}
+	return endpoints
+}
+
+// hostPort host:port of an address like https://host[:port], the port defaults to that of the scheme
+func hostPort(addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid address %s", addr)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "80"), nil
+}
+
+func dial(ctx context.Context, addr string) error {
+	dialer := &net.Dialer{Timeout: preflightTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// parseImage registry, repository and tag or digest of image, images without a registry are in docker hub
+func parseImage(image string) (string, string, string) {
+	registry, repository := "registry-1.docker.io", image
+	if i := strings.Index(image, "/"); i > 0 && (strings.ContainsAny(image[:i], ".:") || image[:i] == "localhost") {
+		registry, repository = image[:i], image[i+1:]
+	}
+	if registry == "registry-1.docker.io" && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	if i := strings.Index(repository, "@"); i > 0 {
+		return registry, repository[:i], repository[i+1:]
+	}
+	if i := strings.LastIndex(repository, ":"); i > 0 {
+		return registry, repository[:i], repository[i+1:]
+	}
+	return registry, repository, "latest"
+}
+
+// checkImage check the manifest of image exists in its registry, https is tried before http, anonymous pull
+// tokens are requested if the registry asks for them
+func checkImage(ctx context.Context, image string) error {
+	registry, repository, reference := parseImage(image)
+	client := &http.Client{
+		Timeout: preflightTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint
+		},
+	}
+
+	var firstErr error
+	for _, scheme := range []string{"https", "http"} {
+		manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registry, repository, reference)
+		resp, err := requestManifest(ctx, client, manifestURL, "")
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			token, err := anonymousToken(ctx, client, resp.Header.Get("WWW-Authenticate"))
+			if err != nil {
+				return fmt.Errorf("%w, %v", errImageUnverified, err)
+			}
+			if resp, err = requestManifest(ctx, client, manifestURL, token); err != nil {
+				return err
+			}
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return errImageUnverified
+		case http.StatusNotFound:
+			return fmt.Errorf("image %s not found in registry %s", image, registry)
+		default:
+			return fmt.Errorf("registry %s answered %s", registry, resp.Status)
+		}
+	}
+	return firstErr
+}
+
+// requestManifest HEAD the manifest at manifestURL, the body is closed before returning
+func requestManifest(ctx context.Context, client *http.Client, manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// anonymousToken request a pull token without credentials as the Bearer challenge asks
+func anonymousToken(ctx context.Context, client *http.Client, challenge string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+	params := make(map[string]string, 0)
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid realm in challenge %q", challenge)
+	}
+	query := realm.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			query.Set(k, params[k])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token from %s failed, %s", realm.Host, resp.Status)
+	}
+	result := &struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return "", err
+	}
+	return orDefault(result.Token, result.AccessToken), nil
+}
@@ -0,0 +1,314 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+// report formats
+const (
+	reportFormatJSON     = "json"
+	reportFormatCSV      = "csv"
+	reportFormatMarkdown = "markdown"
+)
+
+const defaultReportDir = "./reports"
+
+// phase status in report
+const (
+	statusSuccess   = "success"
+	statusFailed    = "failed"
+	statusSkipped   = "skipped"
+	statusPlanned   = "planned"
+	statusUnchanged = "unchanged"
+)
+
+// phases only recorded in report, the others are shared with journal steps
+const (
+	phaseResume      = "resumed_from_journal"
+	phaseOverridden  = "skipped_by_overrides"
+	phaseMasterNodes = "master_nodes_fetched"
+	phaseVerify      = "verified"
+	phaseReachable   = "reachable_by_gateway"
+	phaseBackup      = "backed_up"
+	phaseCleanup     = "cleaned_up"
+	phaseRestore     = "restored"
+	// phases of rollback
+	phaseWatchRemoved   = "watch_removed"
+	phaseAgentRemoved   = "agent_removed"
+	phaseCcReverted     = "cc_reverted"
+	phaseClusterDeleted = "cluster_deleted"
+	phaseProjectDeleted = "project_deleted"
+)
+
+// report item types
+const (
+	itemTypeProject = "project"
+	itemTypeCluster = "cluster"
+)
+
+// reportPhase a phase that project or cluster went through
+type reportPhase struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Time   string `json:"time"`
+}
+
+// reportItem result of a project or cluster
+type reportItem struct {
+	Type      string        `json:"type"`
+	ProjectID string        `json:"projectID"`
+	Name      string        `json:"name"`
+	OldID     string        `json:"oldID"`
+	NewID     string        `json:"newID"`
+	Phases    []reportPhase `json:"phases"`
+	KubeAgent string        `json:"kubeAgent,omitempty"`
+	K8SWatch  string        `json:"k8sWatch,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// reportWave result of a wave in wave rollout
+type reportWave struct {
+	Name      string   `json:"name"`
+	Clusters  []string `json:"clusters"`
+	Succeeded int      `json:"succeeded"`
+	Failed    []string `json:"failed"`
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	Time      string   `json:"time"`
+}
+
+// report result of a run, written as json, csv or markdown
+type report struct {
+	lock  sync.Mutex
+	index map[string]*reportItem
+
+	Command   string        `json:"command"`
+	DryRun    bool          `json:"dryRun"`
+	StartTime string        `json:"startTime"`
+	EndTime   string        `json:"endTime"`
+	Error     string        `json:"error,omitempty"`
+	Items     []*reportItem `json:"items"`
+	Waves     []reportWave  `json:"waves,omitempty"`
+}
+
+func newReport(command string, dryRun bool) *report {
+	return &report{
+		index:     make(map[string]*reportItem, 0),
+		Command:   command,
+		DryRun:    dryRun,
+		StartTime: time.Now().Format(time.RFC3339),
+		Items:     make([]*reportItem, 0),
+	}
+}
+
+// recordProject record phase of project
+func (r *report) recordProject(projectID, name, phase, status, errMsg string) {
+	r.record(itemTypeProject, projectID, projectID, projectID, name, phase, status, errMsg)
+}
+
+// recordCluster record phase of cluster, originClusterID is the clusterID in 1.18
+func (r *report) recordCluster(originClusterID, clusterID, projectID, name, phase, status, errMsg string) {
+	r.record(itemTypeCluster, originClusterID, clusterID, projectID, name, phase, status, errMsg)
+}
+
+func (r *report) record(itemType, oldID, newID, projectID, name, phase, status, errMsg string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := itemType + "/" + oldID
+	item, ok := r.index[key]
+	if !ok {
+		item = &reportItem{
+			Type:      itemType,
+			ProjectID: projectID,
+			Name:      name,
+			OldID:     oldID,
+			Phases:    make([]reportPhase, 0),
+		}
+		r.index[key] = item
+		r.Items = append(r.Items, item)
+	}
+	if newID != "" {
+		item.NewID = newID
+	}
+	item.Phases = append(item.Phases, reportPhase{
+		Name:   phase,
+		Status: status,
+		Error:  options.Redact(errMsg),
+		Time:   time.Now().Format(time.RFC3339),
+	})
+	if errMsg != "" {
+		item.Error = options.Redact(errMsg)
+	}
+	switch phase {
+	case stepAgentDeployed, stepAgentReady, stepAgentRegistered:
+		item.KubeAgent = status
+	case stepWatchDeployed, stepWatchReady:
+		item.K8SWatch = status
+	}
+}
+
+// recordWave record result of a wave, clusters are clusterIDs in 1.18
+func (r *report) recordWave(name string, clusters []string, succeeded int, failed []string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	wave := reportWave{
+		Name:      name,
+		Clusters:  clusters,
+		Succeeded: succeeded,
+		Failed:    failed,
+		Status:    statusSuccess,
+		Time:      time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		wave.Status = statusFailed
+		wave.Error = options.Redact(err.Error())
+	}
+	r.Waves = append(r.Waves, wave)
+}
+
+// summary count of items by type and final status
+func (r *report) summary() map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result := make(map[string]int, 0)
+	for _, item := range r.Items {
+		status := statusSuccess
+		if item.Error != "" {
+			status = statusFailed
+		}
+		result[item.Type+" "+status]++
+	}
+	return result
+}
+
+// write write report in all configured formats
+func (r *report) write(conf options.ReportConf) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.EndTime = time.Now().Format(time.RFC3339)
+	r.Error = options.Redact(r.Error)
+	dir := conf.Dir
+	if dir == "" {
+		dir = defaultReportDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	formats := conf.Formats
+	if len(formats) == 0 {
+		formats = []string{reportFormatJSON}
+	}
+
+	name := fmt.Sprintf("%s-report-%s", r.Command, time.Now().Format("20060102150405"))
+	for _, format := range formats {
+		var (
+			data []byte
+			ext  string
+			err  error
+		)
+		switch format {
+		case reportFormatJSON:
+			data, err = json.MarshalIndent(r, "", "  ")
+			ext = "json"
+		case reportFormatCSV:
+			data, err = r.csv()
+			ext = "csv"
+		case reportFormatMarkdown:
+			data = r.markdown()
+			ext = "md"
+		default:
+			return fmt.Errorf("unknown report format %s", format)
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, name+"."+ext)
+		if err = ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		blog.Infof("write %s report to %s", format, path)
+	}
+
+	return nil
+}
+
+func (item *reportItem) phases() string {
+	phases := make([]string, 0, len(item.Phases))
+	for _, p := range item.Phases {
+		phases = append(phases, p.Name+":"+p.Status)
+	}
+	return strings.Join(phases, ";")
+}
+
+func (r *report) csv() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	rows := [][]string{{"type", "project_id", "name", "old_id", "new_id", "phases", "kube_agent", "k8s_watch",
+		"error"}}
+	for _, item := range r.Items {
+		rows = append(rows, []string{item.Type, item.ProjectID, item.Name, item.OldID, item.NewID,
+			item.phases(), item.KubeAgent, item.K8SWatch, item.Error})
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *report) markdown() []byte {
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# %s report\n\n", r.Command)
+	fmt.Fprintf(buf, "- dry run: %v\n- start time: %s\n- end time: %s\n", r.DryRun, r.StartTime, r.EndTime)
+	if r.Error != "" {
+		fmt.Fprintf(buf, "- error: %s\n", escape.Replace(r.Error))
+	}
+	buf.WriteString("\n| type | project id | name | old id | new id | phases | kube agent | k8s watch | error |\n")
+	buf.WriteString("| ---- | ---------- | ---- | ------ | ------ | ------ | ---------- | --------- | ----- |\n")
+	for _, item := range r.Items {
+		fmt.Fprintf(buf, "| %s | %s | %s | %s | %s | %s | %s | %s | %s |\n", item.Type, item.ProjectID,
+			escape.Replace(item.Name), item.OldID, item.NewID, strings.ReplaceAll(item.phases(), ";", "<br>"),
+			item.KubeAgent, item.K8SWatch, escape.Replace(item.Error))
+	}
+	if len(r.Waves) > 0 {
+		buf.WriteString("\n| wave | clusters | succeeded | failed | status | error |\n")
+		buf.WriteString("| ---- | -------- | --------- | ------ | ------ | ----- |\n")
+		for _, w := range r.Waves {
+			fmt.Fprintf(buf, "| %s | %d | %d | %s | %s | %s |\n", w.Name, len(w.Clusters), w.Succeeded,
+				strings.Join(w.Failed, "<br>"), w.Status, escape.Replace(w.Error))
+		}
+	}
+	return buf.Bytes()
+}
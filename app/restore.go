@@ -0,0 +1,173 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// DoRestore restore the old bcs kube agent and bcs k8s watch from backups written by cleanup, objects deleted
+// are created again and Deployments scaled down are scaled back to their replicas in backups
+func (app *App) DoRestore(ctx context.Context) error {
+	err := app.initClients()
+	if err != nil {
+		return err
+	}
+	defer app.closeClients()
+
+	ctx, unlock, err := app.lockRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	migrated, changedClusters, err := app.listMigratedClusters(ctx)
+	if err != nil {
+		return err
+	}
+	blog.Infof("will restore old components of %d migrated clusters from %s", len(migrated), backupDir(app.op))
+
+	failedClusters := newClusterErrors()
+	app.parallelize(ctx, len(migrated), func(ctx context.Context, i int) {
+		c := migrated[i]
+		origin := changedClusters.origin(c.ClusterID)
+		dir := filepath.Join(backupDir(app.op), c.ClusterID)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			blog.Infof("no backups of cluster %s[%s], skipping...", c.ClusterName, c.ClusterID)
+			return
+		}
+
+		err := app.restoreCluster(ctx, c, dir, changedClusters)
+		if err != nil {
+			blog.Errorf("restore old components for cluster %s[%s] failed, %v", c.ClusterName, c.ClusterID, err)
+			app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseRestore,
+				statusFailed, err.Error())
+			failedClusters.add(c.ClusterID, err)
+			return
+		}
+		status := statusSuccess
+		if app.op.DryRun {
+			status = statusPlanned
+		}
+		app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseRestore, status, "")
+		blog.Infof("restore old components for cluster %s[%s] success", c.ClusterName, c.ClusterID)
+	})
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if app.op.DryRun {
+		app.printDryRunChanges()
+	}
+	if failed := failedClusters.all(); len(failed) > 0 {
+		return fmt.Errorf("%d clusters failed to restore: %v", len(failed), failed)
+	}
+
+	return nil
+}
+
+// restoreCluster apply backups in dir to cluster in the order of backupOrder
+func (app *App) restoreCluster(ctx context.Context, cluster types.ClusterM, dir string,
+	changeClusters *clusterIDMapping) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	// file names start with the index in backupOrder
+	sort.Strings(files)
+
+	clientset, err := generateClientset(ctx, app.op, cluster, changeClusters.origin(cluster.ClusterID))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+		if err != nil {
+			return fmt.Errorf("decode backup %s failed, %v", file, err)
+		}
+		if app.op.DryRun {
+			app.recordChange("restore %s in cluster %s[%s]", filepath.Base(file), cluster.ClusterName,
+				cluster.ClusterID)
+			continue
+		}
+		if err = restoreObject(ctx, clientset, obj); err != nil {
+			return fmt.Errorf("restore %s failed, %v", file, err)
+		}
+		blog.Infof("restore %s in cluster %s", filepath.Base(file), cluster.ClusterID)
+	}
+
+	return nil
+}
+
+// restoreObject create object from backup, Deployment existed is scaled to the replicas in backup
+// and other objects existed are kept as they are
+func restoreObject(ctx context.Context, clientset *kubernetes.Clientset, obj interface{}) error {
+	var err error
+	opts := metav1.CreateOptions{}
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		_, err = clientset.AppsV1().Deployments(o.Namespace).Create(ctx, o, opts)
+		if errors.IsAlreadyExists(err) {
+			scale, err := clientset.AppsV1().Deployments(o.Namespace).GetScale(ctx, o.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			scale.Spec.Replicas = 1
+			if o.Spec.Replicas != nil {
+				scale.Spec.Replicas = *o.Spec.Replicas
+			}
+			_, err = clientset.AppsV1().Deployments(o.Namespace).UpdateScale(ctx, o.Name, scale, metav1.UpdateOptions{})
+			return err
+		}
+	case *corev1.ServiceAccount:
+		_, err = clientset.CoreV1().ServiceAccounts(o.Namespace).Create(ctx, o, opts)
+	case *corev1.Secret:
+		_, err = clientset.CoreV1().Secrets(o.Namespace).Create(ctx, o, opts)
+	case *rbacv1.ClusterRole:
+		_, err = clientset.RbacV1().ClusterRoles().Create(ctx, o, opts)
+	case *rbacv1.Role:
+		_, err = clientset.RbacV1().Roles(o.Namespace).Create(ctx, o, opts)
+	case *rbacv1.ClusterRoleBinding:
+		_, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, o, opts)
+	case *rbacv1.RoleBinding:
+		_, err = clientset.RbacV1().RoleBindings(o.Namespace).Create(ctx, o, opts)
+	default:
+		return fmt.Errorf("unsupported object %T", obj)
+	}
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
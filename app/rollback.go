@@ -0,0 +1,343 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/components"
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// clusterStatusRemoved status of clusters removed from bcs cc
+const clusterStatusRemoved = "removed"
+
+// DoRollback undo what migrate did according to the journal or a migrate report, the new bcs kube agent
+// (or its helm release), bcs k8s watch and their cert secrets are removed, clusters are removed from bcs cc
+// and cluster manager, projects are deleted if rollback.delete_projects is set
+func (app *App) DoRollback(ctx context.Context) error {
+	err := app.initClients()
+	if err != nil {
+		return err
+	}
+	defer app.closeClients()
+
+	ctx, unlock, err := app.lockRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	app.journal, err = loadJournal(app.op.JournalPath, app.op.DryRun)
+	if err != nil {
+		return err
+	}
+	projects, clusters := app.journal.projects(), app.journal.clusters()
+	if app.op.Rollback.ReportPath != "" {
+		projects, clusters, err = loadReportRecords(app.op.Rollback.ReportPath)
+		if err != nil {
+			return err
+		}
+	}
+	blog.Infof("will rollback %d clusters", len(clusters))
+
+	changedClusters := newClusterIDMapping()
+	for _, record := range clusters {
+		changedClusters.set(record.ClusterID, record.OriginClusterID)
+	}
+
+	failedClusters := newClusterErrors()
+	app.parallelize(ctx, len(clusters), func(ctx context.Context, i int) {
+		record := clusters[i]
+		err := app.rollbackCluster(ctx, record, changedClusters)
+		if err != nil {
+			blog.Errorf("rollback cluster %s[%s] failed, %v", record.ClusterName, record.ClusterID, err)
+			failedClusters.add(record.OriginClusterID, err)
+			return
+		}
+		blog.Infof("rollback cluster %s[%s] success", record.ClusterName, record.ClusterID)
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	failedProjects := make(map[string]string, 0)
+	if app.op.Rollback.DeleteProjects {
+		for _, record := range projects {
+			if err := app.rollbackProject(ctx, record); err != nil {
+				blog.Errorf("delete project %s[%s] failed, %v", record.Name, record.ProjectID, err)
+				failedProjects[record.ProjectID] = err.Error()
+			}
+		}
+	}
+
+	if app.op.DryRun {
+		app.printDryRunChanges()
+	}
+	if failed := failedClusters.all(); len(failed) > 0 {
+		return fmt.Errorf("%d clusters failed to rollback: %v", len(failed), failed)
+	}
+	if len(failedProjects) > 0 {
+		return fmt.Errorf("%d projects failed to rollback: %v", len(failedProjects), failedProjects)
+	}
+
+	return nil
+}
+
+// rollbackCluster undo the steps of cluster in reverse order, steps undone are removed from journal
+func (app *App) rollbackCluster(ctx context.Context, record clusterRecord, changedClusters *clusterIDMapping) error {
+	cluster := types.ClusterM{
+		ClusterID:   record.ClusterID,
+		ClusterName: record.ClusterName,
+		ProjectID:   record.ProjectID,
+	}
+	done := func(step string) bool {
+		_, ok := record.Steps[step]
+		return ok
+	}
+	mark := func(phase string, err error) {
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		app.report.recordCluster(record.OriginClusterID, record.ClusterID, record.ProjectID, record.ClusterName,
+			phase, statusOf(errMsg), errMsg)
+	}
+
+	if done(stepWatchDeployed) || done(stepWatchSecretCreated) {
+		if app.op.DryRun {
+			app.recordChange("remove k8s watch and secret %s from cluster %s[%s]", app.op.BCSCertName,
+				cluster.ClusterName, cluster.ClusterID)
+		} else {
+			op := app.clusterOption(record.OriginClusterID)
+			// the cert secret is shared with kube agent in the same namespace, which removes it itself
+			keepSecret := op.K8SWatch.Namespace == op.KubeAgent.Namespace &&
+				(done(stepAgentDeployed) || done(stepSecretCreated) || done(stepAgentObjects))
+			err := removeK8SWatch(ctx, op, cluster, changedClusters, keepSecret)
+			mark(phaseWatchRemoved, err)
+			if err != nil {
+				return err
+			}
+			app.journal.unmarkCluster(record.OriginClusterID, stepWatchReady, stepWatchDeployed,
+				stepWatchSecretCreated)
+		}
+	}
+
+	if done(stepAgentDeployed) || done(stepSecretCreated) || done(stepAgentObjects) {
+		if app.op.DryRun {
+			app.recordChange("remove kube agent and secret %s from cluster %s[%s]", app.op.BCSCertName,
+				cluster.ClusterName, cluster.ClusterID)
+		} else {
+			err := removeKubeAgent(ctx, app.clusterOption(record.OriginClusterID), cluster, changedClusters)
+			mark(phaseAgentRemoved, err)
+			if err != nil {
+				return err
+			}
+			app.journal.unmarkCluster(record.OriginClusterID, stepAgentRegistered, stepAgentReady, stepAgentDeployed,
+				stepSecretCreated, stepAgentObjects)
+		}
+	}
+
+	if done(stepClusterSyncedToCc) {
+		if app.op.DryRun {
+			app.recordChange("update cluster %s[%s] status to %s in bcs cc", cluster.ClusterName,
+				cluster.ClusterID, clusterStatusRemoved)
+		} else {
+			err := app.removeClusterFromCc(ctx, cluster)
+			mark(phaseCcReverted, err)
+			if err != nil {
+				return err
+			}
+			app.journal.unmarkCluster(record.OriginClusterID, stepClusterStatus, stepClusterSyncedToCc)
+		}
+	}
+
+	if done(stepClusterInserted) {
+		if app.op.DryRun {
+			app.recordChange("delete cluster %s[%s] from cluster manager", cluster.ClusterName, cluster.ClusterID)
+		} else {
+			err := app.deleteClusterM(ctx, cluster)
+			mark(phaseClusterDeleted, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !app.op.DryRun {
+		app.journal.resetCluster(record.OriginClusterID)
+	}
+	return nil
+}
+
+// rollbackProject delete project created by migrate, projects existed before are kept
+func (app *App) rollbackProject(ctx context.Context, record projectRecord) error {
+	if _, ok := record.Steps[stepProjectCreated]; !ok {
+		return nil
+	}
+	if app.op.DryRun {
+		app.recordChange("delete project %s[%s] from bcs project manager", record.Name, record.ProjectID)
+		return nil
+	}
+
+	err := app.projectManager.DeleteProject(ctx, record.ProjectID)
+	if components.IsNotFound(err) {
+		blog.Warnf("project %s[%s] not found in bcs project manager", record.Name, record.ProjectID)
+		err = nil
+	}
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	app.report.recordProject(record.ProjectID, record.Name, phaseProjectDeleted, statusOf(errMsg), errMsg)
+	if err != nil {
+		return err
+	}
+	app.journal.resetProject(record.ProjectID)
+	return nil
+}
+
+// removeClusterFromCc mark cluster synced to bcs cc as removed
+func (app *App) removeClusterFromCc(ctx context.Context, cluster types.ClusterM) error {
+	resp, err := app.bcsCc.GetAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	return app.bcsCc.UpdateCluster(ctx, cluster.ProjectID, cluster.ClusterID, resp.Data.AccessToken,
+		&components.ClusterParamsRequest{
+			Status: clusterStatusRemoved,
+		})
+}
+
+// loadReportRecords get projects and clusters with successful steps from a migrate report in json
+func loadReportRecords(path string) ([]projectRecord, []clusterRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &report{}
+	if err = json.Unmarshal(data, r); err != nil {
+		return nil, nil, fmt.Errorf("decode report %s failed, %v", path, err)
+	}
+	if r.Command != CommandMigrate || r.DryRun {
+		return nil, nil, fmt.Errorf("report %s is not written by a migrate run", path)
+	}
+
+	projects, clusters := make([]projectRecord, 0), make([]clusterRecord, 0)
+	for _, item := range r.Items {
+		steps := make(map[string]string, 0)
+		for _, p := range item.Phases {
+			if p.Status == statusSuccess {
+				steps[p.Name] = p.Time
+			}
+		}
+		switch item.Type {
+		case itemTypeProject:
+			projects = append(projects, projectRecord{ProjectID: item.OldID, Name: item.Name, Steps: steps})
+		case itemTypeCluster:
+			if item.NewID == "" {
+				continue
+			}
+			clusters = append(clusters, clusterRecord{
+				OriginClusterID: item.OldID,
+				ClusterID:       item.NewID,
+				ProjectID:       item.ProjectID,
+				ClusterName:     item.Name,
+				Steps:           steps,
+			})
+		}
+	}
+	blog.Infof("loaded report %s with %d projects and %d clusters", path, len(projects), len(clusters))
+
+	return projects, clusters, nil
+}
+
+// removeKubeAgent remove the new bcs kube agent and its cert secret from cluster, objects not created by upgrade
+// tool are kept
+func removeKubeAgent(ctx context.Context, op *options.UpgradeOption, cluster types.ClusterM,
+	changeClusters *clusterIDMapping) error {
+	config, err := generateRestConfig(ctx, op, cluster, changeClusters.origin(cluster.ClusterID))
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// objects are removed in reverse order, the Deployment first and the cert secret last
+	objects := []runtime.Object{certSecretObject(op, op.KubeAgent.Namespace)}
+	if kubeAgentByHelm(op) {
+		err = uninstallRelease(config, op.KubeAgent.Namespace, kubeAgentRelease(op))
+		if err != nil {
+			return err
+		}
+	} else {
+		m, err := loadManifest(op.KubeAgent.YamlPath,
+			newManifestVars(op, cluster, changeClusters.origin(cluster.ClusterID)))
+		if err != nil {
+			return err
+		}
+		if err = m.renderObjects(op.KubeAgent.Namespace); err != nil {
+			return err
+		}
+		m.deployment.Namespace = op.KubeAgent.Namespace
+		objects = append(append(objects, m.objects...), m.deployment)
+	}
+
+	return removeObjects(ctx, clientset, objects)
+}
+
+// removeK8SWatch remove the new bcs k8s watch from cluster, and its cert secret unless keepSecret is set,
+// objects not created by upgrade tool are kept
+func removeK8SWatch(ctx context.Context, op *options.UpgradeOption, cluster types.ClusterM,
+	changeClusters *clusterIDMapping, keepSecret bool) error {
+	deployment, err := loadDeployment(op.K8SWatch.YamlPath)
+	if err != nil {
+		return err
+	}
+	deployment.Namespace = op.K8SWatch.Namespace
+
+	clientset, err := generateClientset(ctx, op, cluster, changeClusters.origin(cluster.ClusterID))
+	if err != nil {
+		return err
+	}
+
+	objects := []runtime.Object{deployment}
+	if !keepSecret {
+		objects = append([]runtime.Object{certSecretObject(op, op.K8SWatch.Namespace)}, objects...)
+	}
+	return removeObjects(ctx, clientset, objects)
+}
+
+// certSecretObject the cert secret bcs_cert_name in namespace
+func certSecretObject(op *options.UpgradeOption, namespace string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      op.BCSCertName,
+			Namespace: namespace,
+		},
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+const (
+	defaultRolloutTimeout = 5 * time.Minute
+	rolloutPollInterval   = 5 * time.Second
+	diagnosticLogLines    = int64(50)
+)
+
+func rolloutTimeout(op *options.UpgradeOption) time.Duration {
+	if op.RolloutTimeout <= 0 {
+		return defaultRolloutTimeout
+	}
+	return time.Duration(op.RolloutTimeout) * time.Second
+}
+
+// waitForRollout wait until all replicas of Deployment are updated and ready, logs and events of its pods
+// are collected into the error if the rollout does not finish in time
+func waitForRollout(ctx context.Context, op *options.UpgradeOption, clientset kubernetes.Interface,
+	namespace, name string) error {
+	waitCtx, cancel := context.WithTimeout(ctx, rolloutTimeout(op))
+	defer cancel()
+
+	var deployment *appsv1.Deployment
+	reason := ""
+	err := wait.PollImmediateUntil(rolloutPollInterval, func() (bool, error) {
+		var err error
+		deployment, err = clientset.AppsV1().Deployments(namespace).Get(waitCtx, name, metav1.GetOptions{})
+		if err != nil {
+			reason = err.Error()
+			return false, nil
+		}
+		var done bool
+		done, reason = rolloutDone(deployment)
+		return done, nil
+	}, waitCtx.Done())
+	if err == nil {
+		return nil
+	}
+
+	if deployment != nil {
+		diagnostics := collectDiagnostics(clientset, deployment)
+		blog.Errorf("rollout of deployment %s/%s failed, %s\n%s", namespace, name, reason, diagnostics)
+		return fmt.Errorf("rollout of deployment %s/%s not finished in %s: %s\n%s", namespace, name,
+			rolloutTimeout(op), reason, diagnostics)
+	}
+	return fmt.Errorf("rollout of deployment %s/%s not finished in %s: %s", namespace, name,
+		rolloutTimeout(op), reason)
+}
+
+// rolloutDone check rollout status of Deployment like kubectl rollout status
+func rolloutDone(d *appsv1.Deployment) (bool, string) {
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	switch {
+	case d.Status.ObservedGeneration < d.Generation:
+		return false, "waiting for deployment spec update to be observed"
+	case d.Status.UpdatedReplicas < replicas:
+		return false, fmt.Sprintf("%d of %d replicas updated", d.Status.UpdatedReplicas, replicas)
+	case d.Status.Replicas > d.Status.UpdatedReplicas:
+		return false, fmt.Sprintf("%d old replicas pending termination", d.Status.Replicas-d.Status.UpdatedReplicas)
+	case d.Status.ReadyReplicas < replicas:
+		return false, fmt.Sprintf("%d of %d replicas ready", d.Status.ReadyReplicas, replicas)
+	}
+	return true, ""
+}
+
+// collectDiagnostics get status, recent logs and events of pods of Deployment
+func collectDiagnostics(clientset kubernetes.Interface, deployment *appsv1.Deployment) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	buf := &bytes.Buffer{}
+	writeEvents(ctx, buf, clientset, deployment.Namespace, "Deployment", deployment.Name)
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		fmt.Fprintf(buf, "invalid selector, %v\n", err)
+		return buf.String()
+	}
+	pods, err := clientset.CoreV1().Pods(deployment.Namespace).List(ctx,
+		metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		fmt.Fprintf(buf, "list pods failed, %v\n", err)
+		return buf.String()
+	}
+	for _, pod := range pods.Items {
+		fmt.Fprintf(buf, "pod %s phase %s\n", pod.Name, pod.Status.Phase)
+		for _, cs := range pod.Status.ContainerStatuses {
+			state := "running"
+			if cs.State.Waiting != nil {
+				state = cs.State.Waiting.Reason + ": " + cs.State.Waiting.Message
+			} else if cs.State.Terminated != nil {
+				state = cs.State.Terminated.Reason + ": " + cs.State.Terminated.Message
+			}
+			fmt.Fprintf(buf, "  container %s ready %v restarts %d, %s\n", cs.Name, cs.Ready, cs.RestartCount, state)
+
+			tail := diagnosticLogLines
+			logs, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+				Container: cs.Name,
+				TailLines: &tail,
+			}).DoRaw(ctx)
+			if err != nil {
+				fmt.Fprintf(buf, "  get logs failed, %v\n", err)
+				continue
+			}
+			fmt.Fprintf(buf, "  last %d lines of logs:\n%s\n", tail, string(logs))
+		}
+		writeEvents(ctx, buf, clientset, pod.Namespace, "Pod", pod.Name)
+	}
+
+	return buf.String()
+}
+
+func writeEvents(ctx context.Context, buf *bytes.Buffer, clientset kubernetes.Interface, namespace, kind,
+	name string) {
+	events, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=%s,involvedObject.name=%s", kind, name),
+	})
+	if err != nil {
+		fmt.Fprintf(buf, "list events of %s %s failed, %v\n", kind, name, err)
+		return
+	}
+	for _, e := range events.Items {
+		fmt.Fprintf(buf, "  event %s %s %s: %s\n", kind, name, e.Reason, e.Message)
+	}
+}
+
+// checkClusterReachable check cluster is reachable through the tunnel of the new bcs kube agent
+func checkClusterReachable(ctx context.Context, op *options.UpgradeOption, clusterID string) error {
+	client, err := kubernetes.NewForConfig(&rest.Config{
+		Host:        op.BCSApiGateway.Addr + "/clusters/" + clusterID,
+		BearerToken: op.BCSApiGateway.Token,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	result := client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx)
+	if err = result.Error(); err != nil {
+		return fmt.Errorf("cluster %s not reachable through bcs api gateway, %v", clusterID, err)
+	}
+
+	return nil
+}
+
+// waitForRegistration wait until cluster is reachable through the tunnel of the new bcs kube agent,
+// the agent needs a while to register to cluster manager after it is ready
+func waitForRegistration(ctx context.Context, op *options.UpgradeOption, clusterID string) error {
+	waitCtx, cancel := context.WithTimeout(ctx, rolloutTimeout(op))
+	defer cancel()
+
+	var lastErr error
+	err := wait.PollImmediateUntil(rolloutPollInterval, func() (bool, error) {
+		lastErr = checkClusterReachable(waitCtx, op, clusterID)
+		return lastErr == nil, nil
+	}, waitCtx.Done())
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+	return err
+}
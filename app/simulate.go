@@ -0,0 +1,583 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"github.com/jinzhu/gorm"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// simSQLDriver driver of the sqlite stand-in of bk_bcs_cc
+const simSQLDriver = "sqlite3"
+
+// fixtures of simulation
+const (
+	simBKClusterID     = "BCS-K8S-00000"
+	simCertName        = "bcs-client-bcs-services-stack"
+	simKubeAgentImage  = "bcs-kube-agent:v1.29.0"
+	simOldImageTag     = "v1.18.0"
+	simOtherProjectID  = "sim-project-other"
+	simTakenClusterID  = "BCS-K8S-15003"
+	simSkippedCluster  = "BCS-K8S-15000"
+	simExistingProject = "sim-project-b"
+)
+
+// simBKEStatements tables and tokens of the old bcs api in bke_core, only the unexpired token of the super user
+// is valid
+var simBKEStatements = []string{
+	"CREATE TABLE bke_core.users (id integer PRIMARY KEY, name varchar(64), is_super_user bool)",
+	"CREATE TABLE bke_core.user_tokens (id integer PRIMARY KEY, user_id integer, type integer, value varchar(64), " +
+		"expires_at datetime)",
+	"INSERT INTO bke_core.users VALUES (1, 'admin', 1), (2, 'sim-user', 0)",
+	"INSERT INTO bke_core.user_tokens VALUES (1, 1, 1, 'sim-expired-token', '2000-01-01 00:00:00'), " +
+		"(2, 1, 1, '" + simBCSApiToken + "', NULL), (3, 2, 1, 'sim-user-token', NULL)",
+}
+
+// simKubeconfig kubeconfig of the blueking cluster, formatted with its server address
+const simKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: sim-bk-cluster
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+users:
+- name: sim-admin
+  user:
+    token: ` + simBKClusterToken + `
+contexts:
+- name: sim
+  context:
+    cluster: sim-bk-cluster
+    user: sim-admin
+current-context: sim
+`
+
+// simKubeAgentManifest the new bcs kube agent used when kube_agent.yaml_path is not set
+const simKubeAgentManifest = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: bcs-kube-agent-v2
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bcs-kube-agent-v2
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: bcs-kube-agent-v2
+  template:
+    metadata:
+      labels:
+        app: bcs-kube-agent-v2
+    spec:
+      serviceAccountName: bcs-kube-agent-v2
+      containers:
+        - name: bcs-kube-agent-v2
+          args:
+            - --use-websocket=true
+          volumeMounts:
+            - name: bcs-certs
+              mountPath: /data/bcs/cert/bcs
+      volumes:
+        - name: bcs-certs
+          secret:
+            secretName: {{ .CertSecretName }}
+`
+
+// simProjects projects in bk_bcs_cc, simExistingProject exists in bcs project manager already
+var simProjects = []types.Project{
+	{Name: "sim-project-a", EnglishName: "sima", ProjectID: "sim-project-a", Creator: "admin", CCAppID: 100,
+		Kind: 1, DeployType: "2"},
+	{Name: "sim-project-b", EnglishName: "simb", ProjectID: simExistingProject, Creator: "admin", CCAppID: 200,
+		Kind: 1, DeployType: "2"},
+}
+
+// simClusters clusters in bk_bcs_cc, the clusterID of sim-cluster-3 is taken by a cluster of another project
+// in cluster manager and sim-cluster-0 is not in normal status
+var simClusters = []types.Cluster{
+	{Name: "sim-cluster-0", ProjectID: "sim-project-a", ClusterID: simSkippedCluster, ClusterNum: 15000,
+		Status: "initializing", Type: "k8s", Environment: "stag", State: "bcs_new"},
+	{Name: "sim-cluster-1", ProjectID: "sim-project-a", ClusterID: "BCS-K8S-15001", ClusterNum: 15001,
+		Status: "normal", Type: "k8s", Environment: "prod", State: "bcs_new", NodeCount: 3},
+	{Name: "sim-cluster-2", ProjectID: "sim-project-a", ClusterID: "BCS-K8S-15002", ClusterNum: 15002,
+		Status: "normal", Type: "k8s", Environment: "debug", State: "bcs_new", NodeCount: 2},
+	{Name: "sim-cluster-3", ProjectID: simExistingProject, ClusterID: simTakenClusterID, ClusterNum: 15003,
+		Status: "normal", Type: "k8s", Environment: "prod", State: "existing", NodeCount: 1},
+}
+
+// simulation migrate, verify, migrate again and rollback in a cluster_write_mode against stand-ins
+type simulation struct {
+	mode     string
+	op       *options.UpgradeOption
+	db       *gorm.DB
+	store    *memStore
+	server   *simServer
+	clusters map[string]*simCluster
+	checks   []checkResult
+}
+
+// DoSimulate run migrate, verify, migrate again and rollback end to end against stand-ins of bk_bcs_cc,
+// mongoDB, the old bcs api, bkssm, bcs cc, bcs project manager, cluster manager and clusters, once in each
+// cluster_write_mode. Nothing outside a temporary directory is touched, results of checks are printed as a table
+func (app *App) DoSimulate(ctx context.Context) error {
+	if !hasSQLDriver(simSQLDriver) {
+		return fmt.Errorf("simulate needs the sqlite stand-in of bk_bcs_cc, build with cgo and -tags simulate")
+	}
+	dir, err := ioutil.TempDir("", "upgradetool-simulate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	checks := make([]checkResult, 0)
+	for _, mode := range []string{clusterWriteModeMongo, clusterWriteModeAPI} {
+		sim, err := newSimulation(app.op, filepath.Join(dir, mode), mode)
+		if err != nil {
+			return fmt.Errorf("set up simulation in %s mode failed, %v", mode, err)
+		}
+		sim.run(ctx)
+		sim.close()
+		checks = append(checks, sim.checks...)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	if failed := printCheckResults(os.Stdout, "MODE", checks); failed > 0 {
+		return fmt.Errorf("%d of %d simulation checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// hasSQLDriver whether driver is registered, the sqlite driver is only built with -tags simulate
+func hasSQLDriver(driver string) bool {
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// newSimulation seed stand-ins in dir, kube_agent.yaml_path, namespace and values of op are simulated if set
+func newSimulation(op *options.UpgradeOption, dir, mode string) (*simulation, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	yamlPath := op.KubeAgent.YamlPath
+	if yamlPath == "" {
+		yamlPath = filepath.Join(dir, "kube-agent-deployment.yaml")
+		if err := ioutil.WriteFile(yamlPath, []byte(simKubeAgentManifest), 0644); err != nil {
+			return nil, err
+		}
+	}
+	namespace := orDefault(op.KubeAgent.Namespace, "kube-system")
+
+	db, err := gorm.Open(simSQLDriver, filepath.Join(dir, "bk_bcs_cc.db"))
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite failed, %v", err)
+	}
+	if err = seedSimDatabase(db, dir); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	sim := &simulation{
+		mode: mode,
+		db:   db,
+		store: newMemStore(types.ClusterM{
+			ClusterID:   simTakenClusterID,
+			ClusterName: "other-cluster",
+			ProjectID:   simOtherProjectID,
+			Status:      "RUNNING",
+		}),
+		clusters: make(map[string]*simCluster, 0),
+	}
+	bkCluster := newSimAPIServer()
+	sim.server = newSimServer(sim.store, nil, bkCluster, simBKClusterID, namespace,
+		map[string]string{simExistingProject: "sim-project-b"})
+	// the old bcs kube agent is pulled from the registry of the server, so is the new one
+	oldImage := fmt.Sprintf("%s/%s:%s", strings.TrimPrefix(sim.server.URL, "http://"), simImageRepository,
+		simOldImageTag)
+	clusters := make([]*simCluster, 0, len(simClusters))
+	for i, c := range simClusters {
+		apiserver, err := newSimClusterAPIServer(namespace, fmt.Sprintf("10.0.%d.1", i), oldImage)
+		if err != nil {
+			sim.close()
+			return nil, err
+		}
+		cluster := &simCluster{
+			clusterID:  c.ClusterID,
+			projectID:  c.ProjectID,
+			id:         fmt.Sprintf("%d", 1000+i),
+			identifier: fmt.Sprintf("sim-identifier-%d", i),
+			token:      fmt.Sprintf("sim-cluster-token-%d", i),
+			apiserver:  apiserver,
+		}
+		clusters = append(clusters, cluster)
+		sim.clusters[c.ClusterID] = cluster
+	}
+	sim.server.clusters = clusters
+	if err = seedSimBKCluster(bkCluster); err != nil {
+		sim.close()
+		return nil, err
+	}
+
+	addr := sim.server.URL
+	kubeconfig := filepath.Join(dir, "bk-cluster.kubeconfig")
+	if err = ioutil.WriteFile(kubeconfig, []byte(fmt.Sprintf(simKubeconfig, sim.server.bkServer.URL)), 0600); err != nil {
+		sim.close()
+		return nil, err
+	}
+	sim.op = &options.UpgradeOption{
+		MigrateProjectData: true,
+		MigrateClusterData: true,
+		JournalPath:        filepath.Join(dir, "migrate-journal.json"),
+		Report:             options.ReportConf{Dir: filepath.Join(dir, "reports")},
+		Rollback:           options.Rollback{DeleteProjects: true},
+		Workers:            2,
+		ClusterTimeout:     60,
+		RolloutTimeout:     30,
+		ClusterWriteMode:   mode,
+		Retry:              options.Retry{Attempts: 1},
+		// tokens and the cert name are discovered
+		BCSApi:              options.BCSConf{Addr: addr},
+		BCSApiGateway:       options.BCSConf{Addr: addr},
+		BKClusterID:         simBKClusterID,
+		BKClusterKubeconfig: kubeconfig,
+		BCSCc: options.BCSCc{
+			Addr:      addr,
+			SsmHost:   addr,
+			AppCode:   simAppCode,
+			AppSecret: simAppSecret,
+		},
+		KubeAgent: options.KubeAgent{
+			Enable:        true,
+			YamlPath:      yamlPath,
+			Namespace:     namespace,
+			Image:         simKubeAgentImage,
+			Values:        op.KubeAgent.Values,
+			ClusterValues: op.KubeAgent.ClusterValues,
+		},
+	}
+	return sim, nil
+}
+
+// seedSimDatabase create tables of bk_bcs_cc and insert projects and clusters, bke_core of the old bcs api is
+// attached from dir with its tokens
+func seedSimDatabase(db *gorm.DB, dir string) error {
+	// databases are attached per connection
+	db.DB().SetMaxOpenConns(1)
+	err := db.Exec("ATTACH DATABASE ? AS bke_core", filepath.Join(dir, "bke_core.db")).Error
+	if err != nil {
+		return fmt.Errorf("attach bke_core failed, %v", err)
+	}
+	for _, statement := range simBKEStatements {
+		if err = db.Exec(statement).Error; err != nil {
+			return fmt.Errorf("seed bke_core failed, %v", err)
+		}
+	}
+
+	if err := db.AutoMigrate(sourceModels...).Error; err != nil {
+		return fmt.Errorf("create tables failed, %v", err)
+	}
+	for i := range simProjects {
+		p := simProjects[i]
+		if err := db.Create(&p).Error; err != nil {
+			return fmt.Errorf("insert project %s failed, %v", p.ProjectID, err)
+		}
+	}
+	for i := range simClusters {
+		c := simClusters[i]
+		if err := db.Create(&c).Error; err != nil {
+			return fmt.Errorf("insert cluster %s failed, %v", c.ClusterID, err)
+		}
+	}
+	return nil
+}
+
+// seedSimBKCluster the cert secret, the gateway token in bcs-password and bcs-kube-agent mounting the cert
+// secret in a projected volume in bcs-system of the blueking cluster
+func seedSimBKCluster(s *simAPIServer) error {
+	replicas := int32(1)
+	objects := []struct {
+		resource string
+		obj      runtime.Object
+	}{
+		{"secrets", &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: simCertName, Namespace: bcsSystemNamespace},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				"ca.crt":  []byte("sim ca"),
+				"tls.crt": []byte("sim cert"),
+				"tls.key": []byte("sim key"),
+			},
+		}},
+		{"secrets", &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: bcsPasswordSecret, Namespace: bcsSystemNamespace},
+			Data:       map[string][]byte{gatewayTokenKey: []byte(simGatewayToken)},
+		}},
+		{"deployments", &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: bkKubeAgentName, Namespace: bcsSystemNamespace},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": bkKubeAgentName}},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": bkKubeAgentName}},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: bkKubeAgentName, Image: simKubeAgentImage}},
+						Volumes: []corev1.Volume{{
+							Name: bcsCertsVolume,
+							VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+								Sources: []corev1.VolumeProjection{{
+									Secret: &corev1.SecretProjection{
+										LocalObjectReference: corev1.LocalObjectReference{Name: simCertName},
+									},
+								}},
+							}},
+						}},
+					},
+				},
+			},
+		}},
+	}
+	for _, o := range objects {
+		if err := s.add(o.resource, o.obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSimClusterAPIServer apiserver of a cluster in 1.18 with a master node, kube-proxy in ipvs mode and the
+// old bcs kube agent of oldImage in namespace
+func newSimClusterAPIServer(namespace, masterIP, oldImage string) (*simAPIServer, error) {
+	s := newSimAPIServer()
+	replicas := int32(1)
+	objects := []struct {
+		resource string
+		obj      runtime.Object
+	}{
+		{"nodes", &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-" + masterIP,
+				Labels: map[string]string{"node-role.kubernetes.io/master": ""}},
+			Status: corev1.NodeStatus{
+				Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: masterIP}},
+				NodeInfo:  corev1.NodeSystemInfo{ContainerRuntimeVersion: "containerd://1.6.4"},
+			},
+		}},
+		{"nodes", &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-" + masterIP},
+			Status: corev1.NodeStatus{
+				Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: masterIP + "0"}},
+			},
+		}},
+		{"configmaps", &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-proxy", Namespace: "kube-system"},
+			Data:       map[string]string{"config.conf": "mode: ipvs"},
+		}},
+		{"serviceaccounts", &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: oldKubeAgentName, Namespace: namespace},
+		}},
+		{"deployments", &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: oldKubeAgentName, Namespace: namespace},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": oldKubeAgentName}},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": oldKubeAgentName}},
+					Spec: corev1.PodSpec{
+						ServiceAccountName: oldKubeAgentName,
+						Containers: []corev1.Container{{
+							Name:  oldKubeAgentName,
+							Image: oldImage,
+							Args:  []string{"--bke-address=wss://bcs-api.sim.local:8443"},
+						}},
+					},
+				},
+			},
+		}},
+	}
+	for _, o := range objects {
+		if err := s.add(o.resource, o.obj); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *simulation) close() {
+	s.server.Close()
+	if err := s.db.Close(); err != nil {
+		blog.Errorf("close sqlite failed, %v", err)
+	}
+}
+
+// runCommand run command with a new App sharing the stand-ins, values discovered are not kept between commands
+func (s *simulation) runCommand(ctx context.Context, command string) error {
+	op := *s.op
+	app := NewApp(&op)
+	app.sqlClient = s.db
+	app.store = s.store
+	return app.Run(ctx, command)
+}
+
+func (s *simulation) check(name string, err error) {
+	if err != nil {
+		blog.Errorf("simulation check %s in %s mode failed, %v", name, s.mode, err)
+	}
+	s.checks = append(s.checks, newCheckResult(s.mode, name, err))
+}
+
+func (s *simulation) run(ctx context.Context) {
+	s.check("preflight", s.runCommand(ctx, CommandPreflight))
+	s.check("migrate", s.runCommand(ctx, CommandMigrate))
+	s.check("projects created", s.checkProjects(true))
+	migrated, err := s.checkImported()
+	s.check("clusters imported", err)
+	s.check("clusters synced to bcs cc", s.checkCc(migrated, "normal"))
+	s.check("kube agents deployed", s.checkKubeAgents(migrated, true))
+	s.check("run lock released", s.checkUnlocked())
+
+	s.check("verify", s.runCommand(ctx, CommandVerify))
+
+	s.check("migrate again", s.runCommand(ctx, CommandMigrate))
+	again, err := s.checkImported()
+	if err == nil && fmt.Sprint(again) != fmt.Sprint(migrated) {
+		err = fmt.Errorf("clusterIDs changed from %v to %v", migrated, again)
+	}
+	s.check("migrate again changes nothing", err)
+
+	s.check("rollback", s.runCommand(ctx, CommandRollback))
+	s.check("projects deleted", s.checkProjects(false))
+	s.check("clusters deleted", s.checkDeleted())
+	s.check("clusters removed from bcs cc", s.checkCc(migrated, clusterStatusRemoved))
+	s.check("kube agents removed", s.checkKubeAgents(migrated, false))
+	s.check("run lock released after rollback", s.checkUnlocked())
+}
+
+// checkProjects the project created by migrate exists or not, the project existed before is always kept
+func (s *simulation) checkProjects(created bool) error {
+	for _, p := range simProjects {
+		want := created || p.ProjectID == simExistingProject
+		if s.server.hasProject(p.ProjectID) != want {
+			return fmt.Errorf("project %s exists %v in bcs project manager, want %v", p.ProjectID, !want, want)
+		}
+	}
+	return nil
+}
+
+// checkImported clusters in normal status are imported with their masters, clusterIDs taken are reallocated,
+// the clusterIDs in cluster manager are returned keyed by clusterID in 1.18
+func (s *simulation) checkImported() (map[string]string, error) {
+	clusters, err := s.store.listClusters(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	migrated := make(map[string]string, 0)
+	for _, c := range simClusters {
+		var imported *types.ClusterM
+		for i := range clusters {
+			if clusters[i].ProjectID == c.ProjectID && clusters[i].ClusterName == c.Name {
+				imported = &clusters[i]
+			}
+		}
+		switch {
+		case c.Status != defaultClusterStatus && imported != nil:
+			return nil, fmt.Errorf("cluster %s in status %s is imported", c.ClusterID, c.Status)
+		case c.Status != defaultClusterStatus:
+			continue
+		case imported == nil:
+			return nil, fmt.Errorf("cluster %s not imported", c.ClusterID)
+		case c.ClusterID == simTakenClusterID && imported.ClusterID == c.ClusterID:
+			return nil, fmt.Errorf("clusterID %s taken by another cluster is not reallocated", c.ClusterID)
+		case c.ClusterID != simTakenClusterID && imported.ClusterID != c.ClusterID:
+			return nil, fmt.Errorf("clusterID of %s changed to %s", c.ClusterID, imported.ClusterID)
+		case len(imported.Master) != 1:
+			return nil, fmt.Errorf("cluster %s imported with masters %v", c.ClusterID, imported.Master)
+		}
+		migrated[c.ClusterID] = imported.ClusterID
+	}
+	if other := s.store.getCluster(simTakenClusterID); other == nil || other.ProjectID != simOtherProjectID {
+		return nil, fmt.Errorf("cluster %s of another project is changed", simTakenClusterID)
+	}
+	return migrated, nil
+}
+
+// checkDeleted only the cluster existed before is left in cluster manager
+func (s *simulation) checkDeleted() error {
+	clusters, err := s.store.listClusters(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(clusters) != 1 || clusters[0].ProjectID != simOtherProjectID {
+		return fmt.Errorf("clusters %v left in cluster manager", clusterIDs(clusters))
+	}
+	return nil
+}
+
+// checkCc status of migrated clusters in bcs cc
+func (s *simulation) checkCc(migrated map[string]string, status string) error {
+	for origin, clusterID := range migrated {
+		if got := s.server.ccStatus(clusterID); got != status {
+			return fmt.Errorf("cluster %s[%s] in status %q in bcs cc, want %q", clusterID, origin, got, status)
+		}
+	}
+	return nil
+}
+
+// checkKubeAgents the new bcs kube agent and its cert secret exist or not, the old one is always kept
+func (s *simulation) checkKubeAgents(migrated map[string]string, deployed bool) error {
+	namespace := s.op.KubeAgent.Namespace
+	for origin, clusterID := range migrated {
+		apiserver := s.clusters[origin].apiserver
+		if apiserver.hasAgent(namespace, clusterID) != deployed {
+			return fmt.Errorf("new kube agent of cluster %s[%s] deployed %v, want %v", clusterID, origin,
+				!deployed, deployed)
+		}
+		if (apiserver.get("secrets", namespace, simCertName) != nil) != deployed {
+			return fmt.Errorf("cert secret of cluster %s[%s] created %v, want %v", clusterID, origin,
+				!deployed, deployed)
+		}
+		if apiserver.get("deployments", namespace, oldKubeAgentName) == nil {
+			return fmt.Errorf("old kube agent of cluster %s[%s] is removed", clusterID, origin)
+		}
+	}
+	return nil
+}
+
+func (s *simulation) checkUnlocked() error {
+	if s.store.locked() {
+		return fmt.Errorf("run lock is still held")
+	}
+	return nil
+}
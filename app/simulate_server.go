@@ -0,0 +1,663 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/version"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/components"
+	bcstypes "github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// credentials of the simulated services, calls without them are rejected
+const (
+	simBCSApiToken  = "sim-bcs-api-token"
+	simGatewayToken = "sim-gateway-token"
+	simAppCode      = "sim-app"
+	simAppSecret    = "sim-app-secret"
+	simAccessToken  = "sim-access-token"
+	// simBKClusterToken token in the kubeconfig of the blueking cluster
+	simBKClusterToken = "sim-bk-cluster-token"
+	// simRegistryToken anonymous pull token of the image registry
+	simRegistryToken = "sim-registry-token"
+)
+
+// simImageRepository repository of the bcs kube agent images in the simulated registry
+const simImageRepository = "public/bcs/k8s/bcs-kube-agent"
+
+// simResource resource served by simAPIServer
+type simResource struct {
+	group      string
+	version    string
+	kind       string
+	namespaced bool
+}
+
+// simResources resources the tool reads and writes in clusters, keyed by resource name
+var simResources = map[string]simResource{
+	"namespaces":          {"", "v1", "Namespace", false},
+	"nodes":               {"", "v1", "Node", false},
+	"configmaps":          {"", "v1", "ConfigMap", true},
+	"secrets":             {"", "v1", "Secret", true},
+	"serviceaccounts":     {"", "v1", "ServiceAccount", true},
+	"pods":                {"", "v1", "Pod", true},
+	"events":              {"", "v1", "Event", true},
+	"deployments":         {"apps", "v1", "Deployment", true},
+	"clusterroles":        {"rbac.authorization.k8s.io", "v1", "ClusterRole", false},
+	"clusterrolebindings": {"rbac.authorization.k8s.io", "v1", "ClusterRoleBinding", false},
+	"roles":               {"rbac.authorization.k8s.io", "v1", "Role", true},
+	"rolebindings":        {"rbac.authorization.k8s.io", "v1", "RoleBinding", true},
+}
+
+// simAPIServer kube-apiserver of a simulated cluster keeping objects in memory, Deployments are ready as soon
+// as they are written
+type simAPIServer struct {
+	lock            sync.Mutex
+	objects         map[string]*unstructured.Unstructured
+	resourceVersion int
+}
+
+func newSimAPIServer() *simAPIServer {
+	return &simAPIServer{objects: make(map[string]*unstructured.Unstructured, 0)}
+}
+
+func simObjectKey(resource, namespace, name string) string {
+	return resource + "/" + namespace + "/" + name
+}
+
+// add add object of resource, e.g. fixtures of cluster
+func (s *simAPIServer) add(resource string, obj runtime.Object) error {
+	res, ok := simResources[resource]
+	if !ok {
+		return fmt.Errorf("unknown resource %s", resource)
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(schema.GroupVersionKind{Group: res.group, Version: res.version, Kind: res.kind})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.save(resource, u, 1)
+	return nil
+}
+
+// get get object of resource, nil if not found
+func (s *simAPIServer) get(resource, namespace, name string) *unstructured.Unstructured {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if u, ok := s.objects[simObjectKey(resource, namespace, name)]; ok {
+		return u.DeepCopy()
+	}
+	return nil
+}
+
+// list objects of resource in namespace, all namespaces if it is empty
+func (s *simAPIServer) list(resource, namespace string) []*unstructured.Unstructured {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := make([]string, 0)
+	for key, u := range s.objects {
+		if strings.HasPrefix(key, resource+"/") && (namespace == "" || u.GetNamespace() == namespace) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := make([]*unstructured.Unstructured, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, s.objects[key].DeepCopy())
+	}
+	return result
+}
+
+// save store object with a new resourceVersion, Deployments get a ready status of generation
+func (s *simAPIServer) save(resource string, u *unstructured.Unstructured, generation int64) {
+	s.resourceVersion++
+	u.SetResourceVersion(strconv.Itoa(s.resourceVersion))
+	if u.GetUID() == "" {
+		u.SetUID(types.UID(fmt.Sprintf("sim-%d", s.resourceVersion)))
+		u.SetCreationTimestamp(metav1.NewTime(time.Now()))
+	}
+	if resource == "deployments" {
+		u.SetGeneration(generation)
+		replicas, found, _ := unstructured.NestedInt64(u.Object, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		_ = unstructured.SetNestedField(u.Object, map[string]interface{}{
+			"observedGeneration": generation,
+			"replicas":           replicas,
+			"updatedReplicas":    replicas,
+			"readyReplicas":      replicas,
+			"availableReplicas":  replicas,
+		}, "status")
+	}
+	s.objects[simObjectKey(resource, u.GetNamespace(), u.GetName())] = u
+}
+
+// hasAgent whether a ready Deployment in namespace runs with --cluster-id=clusterID, i.e. the bcs kube agent
+// of clusterID is registered
+func (s *simAPIServer) hasAgent(namespace, clusterID string) bool {
+	for _, u := range s.list("deployments", namespace) {
+		ready, _, _ := unstructured.NestedInt64(u.Object, "status", "readyReplicas")
+		containers, _, _ := unstructured.NestedSlice(u.Object, "spec", "template", "spec", "containers")
+		for _, c := range containers {
+			args, _, _ := unstructured.NestedStringSlice(c.(map[string]interface{}), "args")
+			for _, arg := range args {
+				if arg == "--cluster-id="+clusterID && ready > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *simAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var group, ver string
+	switch {
+	case len(parts) == 1 && parts[0] == "version":
+		writeJSON(w, http.StatusOK, version.Info{Major: "1", Minor: "20", GitVersion: "v1.20.11"})
+		return
+	case len(parts) >= 3 && parts[0] == "api":
+		ver, parts = parts[1], parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		group, ver, parts = parts[1], parts[2], parts[3:]
+	default:
+		writeStatus(w, errors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+		return
+	}
+	namespace := ""
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		namespace, parts = parts[1], parts[2:]
+	}
+	resource, name := parts[0], ""
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+	res, ok := simResources[resource]
+	gr := schema.GroupResource{Group: group, Resource: resource}
+	// subresources like scale and log are not simulated
+	if !ok || res.group != group || res.version != ver || res.namespaced != (namespace != "") || len(parts) > 2 {
+		writeStatus(w, errors.NewNotFound(gr, name))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := simObjectKey(resource, namespace, name)
+	existing := s.objects[key]
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		s.serveList(w, r, res, resource, namespace)
+	case r.Method == http.MethodGet && existing == nil, r.Method == http.MethodPut && existing == nil,
+		r.Method == http.MethodDelete && existing == nil:
+		writeStatus(w, errors.NewNotFound(gr, name))
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, existing.Object)
+	case r.Method == http.MethodPost && name == "", r.Method == http.MethodPut:
+		u, err := decodeObject(r, res, namespace)
+		if err != nil {
+			writeStatus(w, errors.NewBadRequest(err.Error()))
+			return
+		}
+		generation := int64(1)
+		if r.Method == http.MethodPost {
+			if _, ok := s.objects[simObjectKey(resource, namespace, u.GetName())]; ok {
+				writeStatus(w, errors.NewAlreadyExists(gr, u.GetName()))
+				return
+			}
+		} else {
+			if u.GetName() != name {
+				writeStatus(w, errors.NewBadRequest("name of object does not match the url"))
+				return
+			}
+			u.SetUID(existing.GetUID())
+			u.SetCreationTimestamp(existing.GetCreationTimestamp())
+			generation = existing.GetGeneration() + 1
+		}
+		s.save(resource, u, generation)
+		code := http.StatusOK
+		if r.Method == http.MethodPost {
+			code = http.StatusCreated
+		}
+		writeJSON(w, code, u.Object)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		writeJSON(w, http.StatusOK, &metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusSuccess,
+		})
+	default:
+		writeStatus(w, errors.NewMethodNotSupported(gr, r.Method))
+	}
+}
+
+func (s *simAPIServer) serveList(w http.ResponseWriter, r *http.Request, res simResource, resource,
+	namespace string) {
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, errors.NewBadRequest(err.Error()))
+		return
+	}
+	items := make([]interface{}, 0)
+	keys := make([]string, 0)
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		u := s.objects[key]
+		if !strings.HasPrefix(key, resource+"/") || (namespace != "" && u.GetNamespace() != namespace) ||
+			!selector.Matches(labels.Set(u.GetLabels())) {
+			continue
+		}
+		items = append(items, u.Object)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": schema.GroupVersion{Group: res.group, Version: res.version}.String(),
+		"kind":       res.kind + "List",
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.Itoa(s.resourceVersion)},
+		"items":      items,
+	})
+}
+
+// decodeObject decode object in request body, numbers are decoded as int64 like apimachinery does
+func decodeObject(r *http.Request, res simResource, namespace string) (*unstructured.Unstructured, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	content := make(map[string]interface{}, 0)
+	if err = utiljson.Unmarshal(body, &content); err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(schema.GroupVersionKind{Group: res.group, Version: res.version, Kind: res.kind})
+	if u.GetName() == "" {
+		return nil, fmt.Errorf("name of object is required")
+	}
+	u.SetNamespace(namespace)
+	return u, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		blog.Errorf("write simulated response failed, %v", err)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, err *errors.StatusError) {
+	status := err.ErrStatus
+	status.Kind, status.APIVersion = "Status", "v1"
+	writeJSON(w, int(status.Code), &status)
+}
+
+// simCluster a cluster in 1.18 reached through the tunnel of the old bcs api
+type simCluster struct {
+	clusterID string
+	projectID string
+	// id and identifier of cluster in the old bcs api, token is its credential
+	id         string
+	identifier string
+	token      string
+	apiserver  *simAPIServer
+}
+
+// simServer stand-ins of the old bcs api, bkssm, bcs cc, the image registry, and of bcs project manager,
+// cluster manager and clusters behind the new bcs api gateway, all served at one address
+type simServer struct {
+	*httptest.Server
+	// store backs cluster manager, clusters are written into it in api mode
+	store       *memStore
+	clusters    []*simCluster
+	bkCluster   *simAPIServer
+	bkClusterID string
+	// bkServer serves bkCluster directly
+	bkServer           *httptest.Server
+	kubeAgentNamespace string
+
+	lock sync.Mutex
+	// projects in bcs project manager and status of clusters in bcs cc
+	projects   map[string]string
+	ccClusters map[string]string
+}
+
+func newSimServer(store *memStore, clusters []*simCluster, bkCluster *simAPIServer, bkClusterID,
+	kubeAgentNamespace string, projects map[string]string) *simServer {
+	s := &simServer{
+		store:              store,
+		clusters:           clusters,
+		bkCluster:          bkCluster,
+		bkClusterID:        bkClusterID,
+		kubeAgentNamespace: kubeAgentNamespace,
+		projects:           projects,
+		ccClusters:         make(map[string]string, 0),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/clusters/", s.serveBCSApi)
+	mux.HandleFunc("/tunnels/clusters/", s.serveTunnel)
+	mux.HandleFunc("/api/v1/auth/access-tokens", s.serveAccessToken)
+	mux.HandleFunc("/projects/", s.serveBCSCc)
+	mux.HandleFunc("/bcsapi/v4/bcsproject/v1/projects", s.serveProjectManager)
+	mux.HandleFunc("/bcsapi/v4/bcsproject/v1/projects/", s.serveProjectManager)
+	mux.HandleFunc("/bcsapi/v4/clustermanager/v1/cluster", s.serveClusterManager)
+	mux.HandleFunc("/bcsapi/v4/clustermanager/v1/cluster/", s.serveClusterManager)
+	mux.HandleFunc("/clusters/", s.serveGateway)
+	mux.HandleFunc("/v2/", s.serveRegistry)
+	mux.HandleFunc("/service/token", s.serveRegistryToken)
+	s.Server = httptest.NewServer(mux)
+	s.bkServer = httptest.NewTLSServer(http.HandlerFunc(s.serveBKCluster))
+	return s
+}
+
+// Close shut down both servers
+func (s *simServer) Close() {
+	s.bkServer.Close()
+	s.Server.Close()
+}
+
+func authorized(r *http.Request, token string) bool {
+	return r.Header.Get("Authorization") == "Bearer "+token
+}
+
+// serveBCSApi identifiers and credentials of clusters in the old bcs api
+func (s *simServer) serveBCSApi(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, simBCSApiToken) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "unauthorized"})
+		return
+	}
+	if r.URL.Path == "/rest/clusters/bcs/query_by_id" {
+		query := r.URL.Query()
+		for _, c := range s.clusters {
+			if c.clusterID == query.Get("cluster_id") && c.projectID == query.Get("project_id") {
+				writeJSON(w, http.StatusOK, &components.IdentifierResp{ID: c.id, Identifier: c.identifier})
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "cluster not found"})
+		return
+	}
+	for _, c := range s.clusters {
+		if r.URL.Path == "/rest/clusters/"+c.id+"/client_credentials" {
+			writeJSON(w, http.StatusOK, &components.ClusterCredentialResp{
+				ClusterID:  c.clusterID,
+				ServerPath: "/tunnels/clusters/" + c.identifier,
+				UserToken:  c.token,
+			})
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": "cluster not found"})
+}
+
+// serveTunnel apiservers of clusters through the tunnel of the old bcs api
+func (s *simServer) serveTunnel(w http.ResponseWriter, r *http.Request) {
+	for _, c := range s.clusters {
+		prefix := "/tunnels/clusters/" + c.identifier
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			continue
+		}
+		if !authorized(r, c.token) {
+			writeStatus(w, errors.NewUnauthorized("invalid token of cluster "+c.clusterID))
+			return
+		}
+		http.StripPrefix(prefix, c.apiserver).ServeHTTP(w, r)
+		return
+	}
+	writeStatus(w, errors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+}
+
+// serveAccessToken access token of bkssm for bcs cc
+func (s *simServer) serveAccessToken(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-BK-APP-CODE") != simAppCode || r.Header.Get("X-BK-APP-SECRET") != simAppSecret {
+		writeJSON(w, http.StatusOK, &components.AccessTokenResponse{Code: 1, Message: "app permission denied"})
+		return
+	}
+	writeJSON(w, http.StatusOK, &components.AccessTokenResponse{
+		Data: components.AccessTokenData{AccessToken: simAccessToken, Expired: 3600},
+	})
+}
+
+// serveBCSCc clusters synced to bcs cc and updates of their status
+func (s *simServer) serveBCSCc(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("access_token") != simAccessToken {
+		writeJSON(w, http.StatusOK, &components.CommonResp{Code: 1, Message: "unauthorized, invalid access token"})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "clusters":
+		req := &components.SyncClusterReq{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.ProjectID != parts[1] {
+			writeJSON(w, http.StatusOK, &components.CommonResp{Code: 1, Message: "invalid cluster"})
+			return
+		}
+		s.ccClusters[req.ClusterID] = req.Status
+		writeJSON(w, http.StatusOK, &components.SyncClusterResponse{Result: true})
+	case r.Method == http.MethodPut && len(parts) == 4 && parts[2] == "clusters":
+		req := &components.ClusterParamsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJSON(w, http.StatusOK, &components.CommonResp{Code: 1, Message: "invalid cluster"})
+			return
+		}
+		if _, ok := s.ccClusters[parts[3]]; !ok {
+			writeJSON(w, http.StatusOK, &components.CommonResp{Code: 1, Message: "cluster not found"})
+			return
+		}
+		s.ccClusters[parts[3]] = req.Status
+		writeJSON(w, http.StatusOK, &components.CommonResp{})
+	default:
+		writeJSON(w, http.StatusNotFound, &components.CommonResp{Code: 1, Message: "api not found"})
+	}
+}
+
+// serveProjectManager projects in bcs project manager
+func (s *simServer) serveProjectManager(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, simGatewayToken) {
+		writeJSON(w, http.StatusUnauthorized, &components.ProjectResponse{Code: 1, Message: "unauthorized"})
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	projectID := strings.TrimPrefix(r.URL.Path, "/bcsapi/v4/bcsproject/v1/projects/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/bcsapi/v4/bcsproject/v1/projects":
+		req := &components.CreateProjectRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.ProjectID == "" {
+			writeJSON(w, http.StatusOK, &components.ProjectResponse{Code: 1, Message: "invalid project"})
+			return
+		}
+		if _, ok := s.projects[req.ProjectID]; ok {
+			writeJSON(w, http.StatusOK, &components.ProjectResponse{Code: 2,
+				Message: fmt.Sprintf("project %s already exists", req.ProjectID)})
+			return
+		}
+		s.projects[req.ProjectID] = req.Name
+		writeJSON(w, http.StatusOK, &components.ProjectResponse{
+			Data: &components.Project{ProjectID: req.ProjectID, Name: req.Name},
+		})
+	case r.Method == http.MethodDelete && projectID != r.URL.Path:
+		if _, ok := s.projects[projectID]; !ok {
+			writeJSON(w, http.StatusOK, &components.ProjectResponse{Code: 3,
+				Message: fmt.Sprintf("project %s not found", projectID)})
+			return
+		}
+		delete(s.projects, projectID)
+		writeJSON(w, http.StatusOK, &components.ProjectResponse{})
+	default:
+		writeJSON(w, http.StatusNotFound, &components.ProjectResponse{Code: 1, Message: "api not found"})
+	}
+}
+
+// serveClusterManager clusters in bcs cluster manager, kept in store
+func (s *simServer) serveClusterManager(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, simGatewayToken) {
+		writeJSON(w, http.StatusUnauthorized, &components.ClusterManagerResponse{Code: 1, Message: "unauthorized"})
+		return
+	}
+	clusterID := strings.TrimPrefix(r.URL.Path, "/bcsapi/v4/clustermanager/v1/cluster/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/bcsapi/v4/clustermanager/v1/cluster":
+		req := &components.CreateClusterRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.ClusterID == "" || !req.OnlyCreateInfo {
+			writeJSON(w, http.StatusOK, &components.ClusterManagerResponse{Code: 1, Message: "invalid cluster"})
+			return
+		}
+		cluster := clusterOfRequest(req)
+		if err := s.store.insertCluster(r.Context(), cluster); err != nil {
+			writeJSON(w, http.StatusOK, &components.ClusterManagerResponse{Code: 2,
+				Message: fmt.Sprintf("cluster %s already exists", req.ClusterID)})
+			return
+		}
+		writeJSON(w, http.StatusOK, &components.ClusterManagerResponse{Result: true, Data: &cluster})
+	case r.Method == http.MethodDelete && clusterID != r.URL.Path:
+		cluster := s.store.getCluster(clusterID)
+		if cluster == nil {
+			writeJSON(w, http.StatusOK, &components.ClusterManagerResponse{Code: 3,
+				Message: fmt.Sprintf("cluster %s not found", clusterID)})
+			return
+		}
+		_, _ = s.store.deleteCluster(r.Context(), cluster.ClusterID, cluster.ProjectID)
+		writeJSON(w, http.StatusOK, &components.ClusterManagerResponse{Result: true})
+	default:
+		writeJSON(w, http.StatusNotFound, &components.ClusterManagerResponse{Code: 1, Message: "api not found"})
+	}
+}
+
+// clusterOfRequest cluster as cluster manager saves it
+func clusterOfRequest(req *components.CreateClusterRequest) bcstypes.ClusterM {
+	masters := make(map[string]*bcstypes.Node, 0)
+	for _, ip := range req.Master {
+		masters[ip] = &bcstypes.Node{InnerIP: ip, Region: req.Region}
+	}
+	return bcstypes.ClusterM{
+		ClusterID:              req.ClusterID,
+		ClusterName:            req.ClusterName,
+		Provider:               req.Provider,
+		Region:                 req.Region,
+		ProjectID:              req.ProjectID,
+		BusinessID:             req.BusinessID,
+		Environment:            req.Environment,
+		EngineType:             req.EngineType,
+		ClusterType:            req.ClusterType,
+		Creator:                req.Creator,
+		ManageType:             req.ManageType,
+		Master:                 masters,
+		ClusterBasicSettings:   req.ClusterBasicSettings,
+		ClusterAdvanceSettings: req.ClusterAdvanceSettings,
+		NetworkType:            req.NetworkType,
+		Description:            req.Description,
+		Status:                 "RUNNING",
+	}
+}
+
+// serveGateway clusters behind the new bcs api gateway, the blueking cluster holds the cert secret and the
+// other clusters are reachable once their new bcs kube agent is registered
+func (s *simServer) serveGateway(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, simGatewayToken) {
+		writeStatus(w, errors.NewUnauthorized("invalid token of bcs api gateway"))
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/clusters/"), "/", 2)
+	clusterID, prefix := parts[0], "/clusters/"+parts[0]
+	if clusterID == s.bkClusterID {
+		http.StripPrefix(prefix, s.bkCluster).ServeHTTP(w, r)
+		return
+	}
+	for _, c := range s.clusters {
+		if c.apiserver.hasAgent(s.kubeAgentNamespace, clusterID) {
+			http.StripPrefix(prefix, c.apiserver).ServeHTTP(w, r)
+			return
+		}
+	}
+	writeStatus(w, errors.NewServiceUnavailable("cluster "+clusterID+" is not registered"))
+}
+
+// serveBKCluster apiserver of the blueking cluster accessed by its kubeconfig, served in tls since kubeconfig
+// credentials are not sent over http
+func (s *simServer) serveBKCluster(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, simBKClusterToken) {
+		writeStatus(w, errors.NewUnauthorized("invalid token of the blueking cluster"))
+		return
+	}
+	s.bkCluster.ServeHTTP(w, r)
+}
+
+// serveRegistry manifests of the bcs kube agent images, pulls need an anonymous token
+func (s *simServer) serveRegistry(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/", 2)
+	if !authorized(r, simRegistryToken) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="http://%s/service/token",service="sim-registry",scope="repository:%s:pull"`,
+			r.Host, parts[0]))
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "unauthorized"})
+		return
+	}
+	if len(parts) != 2 || parts[0] != simImageRepository {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "manifest unknown"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveRegistryToken anonymous pull tokens of the image registry
+func (s *simServer) serveRegistryToken(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"token": simRegistryToken})
+}
+
+// ccStatus status of cluster in bcs cc, empty if it is not synced
+func (s *simServer) ccStatus(clusterID string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ccClusters[clusterID]
+}
+
+// hasProject whether project exists in bcs project manager
+func (s *simServer) hasProject(projectID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.projects[projectID]
+	return ok
+}
@@ -0,0 +1,155 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// memStore store in memory for simulation, clusters are keyed by clusterID like the unique index in mongoDB
+type memStore struct {
+	lock       sync.Mutex
+	clusters   map[string]types.ClusterM
+	runLock    *runLock
+	clusterNum int
+}
+
+func newMemStore(clusters ...types.ClusterM) *memStore {
+	s := &memStore{clusters: make(map[string]types.ClusterM, 0)}
+	for _, c := range clusters {
+		s.clusters[c.ClusterID] = c
+	}
+	return s
+}
+
+func (s *memStore) listClusters(ctx context.Context) ([]types.ClusterM, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	clusters := make([]types.ClusterM, 0, len(s.clusters))
+	for _, c := range s.clusters {
+		clusters = append(clusters, c)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].ClusterID < clusters[j].ClusterID })
+	return clusters, nil
+}
+
+func (s *memStore) insertCluster(ctx context.Context, cluster types.ClusterM) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.clusters[cluster.ClusterID]; ok {
+		return errClusterExists
+	}
+	s.clusters[cluster.ClusterID] = cluster
+	return nil
+}
+
+func (s *memStore) deleteCluster(ctx context.Context, clusterID, projectID string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.clusters[clusterID]
+	if !ok || c.ProjectID != projectID {
+		return false, nil
+	}
+	delete(s.clusters, clusterID)
+	return true, nil
+}
+
+// getCluster cluster by clusterID, nil if not found
+func (s *memStore) getCluster(clusterID string) *types.ClusterM {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, ok := s.clusters[clusterID]; ok {
+		return &c
+	}
+	return nil
+}
+
+func (s *memStore) takeLock(ctx context.Context, lock runLock) (*runLock, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.runLock != nil && !s.runLock.ExpireAt.Before(lock.AcquiredAt) {
+		holder := *s.runLock
+		return &holder, nil
+	}
+	s.runLock = &lock
+	return nil, nil
+}
+
+func (s *memStore) removeLock(ctx context.Context) (*runLock, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.runLock
+	s.runLock = nil
+	return old, nil
+}
+
+func (s *memStore) renewLock(ctx context.Context, owner string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.runLock == nil || s.runLock.Owner != owner {
+		return false, nil
+	}
+	s.runLock.Heartbeat = now
+	s.runLock.ExpireAt = now.Add(runLockTTL)
+	return true, nil
+}
+
+func (s *memStore) releaseLock(ctx context.Context, owner string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.runLock != nil && s.runLock.Owner == owner {
+		s.runLock = nil
+	}
+	return nil
+}
+
+// locked whether the run lock is held
+func (s *memStore) locked() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.runLock != nil
+}
+
+func (s *memStore) nextClusterNum(ctx context.Context, floor int) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if floor > s.clusterNum {
+		s.clusterNum = floor
+	}
+	s.clusterNum++
+	return s.clusterNum, nil
+}
+
+func (s *memStore) ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memStore) close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build cgo
+// +build cgo
+
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+func TestSimulate(t *testing.T) {
+	for _, mode := range []string{clusterWriteModeMongo, clusterWriteModeAPI} {
+		t.Run(mode, func(t *testing.T) {
+			sim, err := newSimulation(&options.UpgradeOption{}, filepath.Join(t.TempDir(), mode), mode)
+			if err != nil {
+				t.Fatalf("set up simulation failed, %v", err)
+			}
+			sim.run(context.Background())
+			sim.close()
+
+			if len(sim.checks) == 0 {
+				t.Fatal("no checks ran")
+			}
+			for _, c := range sim.checks {
+				if c.status != checkPass {
+					t.Errorf("check %s: %s %s", c.name, c.status, c.detail)
+				}
+			}
+		})
+	}
+}
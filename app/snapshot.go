@@ -0,0 +1,155 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// clusterSnapshot clusters in cluster manager read once and indexed by clusterID and project/name,
+// clusters imported or planned during the run are added to it, safe for concurrent use
+type clusterSnapshot struct {
+	lock       sync.RWMutex
+	byID       map[string]*types.ClusterM
+	byName     map[string][]*types.ClusterM
+	clusterNum int
+}
+
+func newClusterSnapshot() *clusterSnapshot {
+	return &clusterSnapshot{
+		byID:   make(map[string]*types.ClusterM, 0),
+		byName: make(map[string][]*types.ClusterM, 0),
+	}
+}
+
+// loadClusterSnapshot read all clusters in cluster manager with a single query, cluster numbers are allocated
+// above all clusterIDs in bk_bcs_cc as well, so that a renumbered cluster never takes the clusterID of a
+// cluster migrated later, e.g. in a later wave or run
+func (app *App) loadClusterSnapshot(ctx context.Context) (*clusterSnapshot, error) {
+	clusters, err := app.store.listClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sourceIDs := make([]string, 0)
+	err = app.readOnly(ctx, func(tx *gorm.DB) error {
+		return tx.Model(&types.Cluster{}).Pluck("cluster_id", &sourceIDs).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list clusterIDs from mysql failed, %v", err)
+	}
+
+	snapshot := newClusterSnapshot()
+	for _, cluster := range clusters {
+		snapshot.add(cluster)
+	}
+	for _, clusterID := range sourceIDs {
+		if num, ok := parseClusterNum(clusterID); ok {
+			snapshot.reserve(num)
+		}
+	}
+	return snapshot, nil
+}
+
+func nameKey(projectID, clusterName string) string {
+	return projectID + "/" + clusterName
+}
+
+// parseClusterNum get the number of clusterID like BCS-K8S-40000
+func parseClusterNum(clusterID string) (int, bool) {
+	clusterStrs := strings.Split(clusterID, "-")
+	if len(clusterStrs) != 3 {
+		return 0, false
+	}
+	num, err := strconv.Atoi(clusterStrs[2])
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+// add add cluster imported or planned in this run
+func (s *clusterSnapshot) add(cluster types.ClusterM) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := &cluster
+	s.byID[c.ClusterID] = c
+	key := nameKey(c.ProjectID, c.ClusterName)
+	s.byName[key] = append(s.byName[key], c)
+	if num, ok := parseClusterNum(c.ClusterID); ok && num > s.clusterNum {
+		s.clusterNum = num
+	}
+}
+
+// reserve keep num from being allocated
+func (s *clusterSnapshot) reserve(num int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if num > s.clusterNum {
+		s.clusterNum = num
+	}
+}
+
+// get get cluster by clusterID, nil if not found
+func (s *clusterSnapshot) get(clusterID string) *types.ClusterM {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if c, ok := s.byID[clusterID]; ok {
+		cluster := *c
+		return &cluster
+	}
+	return nil
+}
+
+// findImported find the cluster imported from 1.18 by project, name and description, its clusterID is either
+// the same or a new one, nil if not found
+func (s *clusterSnapshot) findImported(c types.Cluster) *types.ClusterM {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, cm := range s.byName[nameKey(c.ProjectID, c.Name)] {
+		if cm.Description == c.Description {
+			cluster := *cm
+			return &cluster
+		}
+	}
+	return nil
+}
+
+// allocateClusterNum allocate a cluster number greater than all clusterIDs seen so far
+func (s *clusterSnapshot) allocateClusterNum() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clusterNum++
+	return s.clusterNum
+}
+
+// maxClusterNum the greatest cluster number of clusterIDs seen or reserved so far
+func (s *clusterSnapshot) maxClusterNum() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.clusterNum
+}
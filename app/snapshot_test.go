@@ -0,0 +1,73 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"testing"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+func TestFindImported(t *testing.T) {
+	snapshot := newClusterSnapshot()
+	snapshot.add(types.ClusterM{ClusterID: "BCS-K8S-15000", ProjectID: "p1", ClusterName: "same",
+		Description: "d"})
+	snapshot.add(types.ClusterM{ClusterID: "BCS-K8S-40001", ProjectID: "p1", ClusterName: "changed",
+		Description: "d"})
+	snapshot.add(types.ClusterM{ClusterID: "BCS-K8S-15002", ProjectID: "p2", ClusterName: "other",
+		Description: "d"})
+
+	tests := []struct {
+		name    string
+		cluster types.Cluster
+		want    string
+	}{
+		{"same clusterID", types.Cluster{ClusterID: "BCS-K8S-15000", ProjectID: "p1", Name: "same",
+			Description: "d"}, "BCS-K8S-15000"},
+		{"changed clusterID", types.Cluster{ClusterID: "BCS-K8S-15001", ProjectID: "p1", Name: "changed",
+			Description: "d"}, "BCS-K8S-40001"},
+		{"other description", types.Cluster{ClusterID: "BCS-K8S-15000", ProjectID: "p1", Name: "same",
+			Description: "x"}, ""},
+		{"other project", types.Cluster{ClusterID: "BCS-K8S-15002", ProjectID: "p1", Name: "other",
+			Description: "d"}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if cm := snapshot.findImported(tt.cluster); cm != nil {
+			got = cm.ClusterID
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllocateClusterNum(t *testing.T) {
+	snapshot := newClusterSnapshot()
+	snapshot.add(types.ClusterM{ClusterID: "BCS-K8S-40001"})
+	snapshot.add(types.ClusterM{ClusterID: "invalid"})
+	snapshot.reserve(40005)
+	snapshot.reserve(15000)
+
+	if got := snapshot.maxClusterNum(); got != 40005 {
+		t.Errorf("maxClusterNum %d, want 40005", got)
+	}
+	if got := snapshot.allocateClusterNum(); got != 40006 {
+		t.Errorf("allocateClusterNum %d, want 40006", got)
+	}
+	snapshot.add(types.ClusterM{ClusterID: "BCS-K8S-40010"})
+	if got := snapshot.allocateClusterNum(); got != 40011 {
+		t.Errorf("allocateClusterNum %d, want 40011", got)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"github.com/jinzhu/gorm"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// sourceModels tables read from bk_bcs_cc in 1.18, the database is never written
+var sourceModels = []interface{}{&types.Project{}, &types.Cluster{}}
+
+// checkSourceSchema check tables in bk_bcs_cc have all columns of the models, nothing is changed
+func checkSourceSchema(db *gorm.DB) error {
+	for _, model := range sourceModels {
+		scope := db.NewScope(model)
+		table := scope.TableName()
+
+		rows, err := db.DB().Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS "+
+			"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table)
+		if err != nil {
+			return fmt.Errorf("query columns of table %s failed, %v", table, err)
+		}
+		columns := make(map[string]bool, 0)
+		for rows.Next() {
+			var column string
+			if err = rows.Scan(&column); err != nil {
+				rows.Close()
+				return fmt.Errorf("query columns of table %s failed, %v", table, err)
+			}
+			columns[column] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("query columns of table %s failed, %v", table, err)
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("table %s not found in mysql database", table)
+		}
+
+		missing := make([]string, 0)
+		for _, field := range scope.GetModelStruct().StructFields {
+			if !field.IsNormal || field.IsIgnored {
+				continue
+			}
+			if !columns[field.DBName] {
+				missing = append(missing, field.DBName)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("table %s is missing columns %v, check the version of bk_bcs_cc", table, missing)
+		}
+		blog.Infof("schema of table %s checked", table)
+	}
+
+	return nil
+}
+
+// readOnly run fn in a read only transaction of bk_bcs_cc, the transaction is always rolled back
+func (app *App) readOnly(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	tx := app.sqlClient.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if tx.Error != nil {
+		return fmt.Errorf("begin read only transaction failed, %v", tx.Error)
+	}
+	defer tx.Rollback()
+
+	return fn(tx)
+}
@@ -0,0 +1,173 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// errClusterExists clusterID is taken in cluster manager
+var errClusterExists = errors.New("cluster already exists in cluster manager")
+
+// store clusters of cluster manager, the run lock and the cluster number counter, kept in mongoDB
+type store interface {
+	// listClusters list all clusters in cluster manager
+	listClusters(ctx context.Context) ([]types.ClusterM, error)
+	// insertCluster insert cluster, errClusterExists is returned if its clusterID is taken
+	insertCluster(ctx context.Context, cluster types.ClusterM) error
+	// deleteCluster delete cluster of project, false is returned if it is not found
+	deleteCluster(ctx context.Context, clusterID, projectID string) (bool, error)
+	// takeLock take the run lock if it is free or expired, the holder is returned if it is taken
+	takeLock(ctx context.Context, lock runLock) (*runLock, error)
+	// removeLock remove the run lock held by anyone, the removed lock is returned if there was one
+	removeLock(ctx context.Context) (*runLock, error)
+	// renewLock renew the run lock of owner, false is returned if owner does not hold it any more
+	renewLock(ctx context.Context, owner string, now time.Time) (bool, error)
+	// releaseLock release the run lock of owner
+	releaseLock(ctx context.Context, owner string) error
+	// nextClusterNum raise the cluster number counter to floor and increase it by one
+	nextClusterNum(ctx context.Context, floor int) (int, error)
+	// ping check the store is reachable with the credentials
+	ping(ctx context.Context) error
+	// close disconnect from the store
+	close(ctx context.Context) error
+}
+
+// mongoStore store in mongoDB of the new environment
+type mongoStore struct {
+	client *mongo.Client
+}
+
+func (s *mongoStore) collection(name string) *mongo.Collection {
+	return s.client.Database(mongoDBNameCluster).Collection(name)
+}
+
+func (s *mongoStore) listClusters(ctx context.Context) ([]types.ClusterM, error) {
+	cursor, err := s.collection(mongoDBCollectionNameCluster).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	clusters := make([]types.ClusterM, 0)
+	for cursor.Next(ctx) {
+		var cluster types.ClusterM
+		if err = cursor.Decode(&cluster); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, cursor.Err()
+}
+
+func (s *mongoStore) insertCluster(ctx context.Context, cluster types.ClusterM) error {
+	_, err := s.collection(mongoDBCollectionNameCluster).InsertOne(ctx, cluster)
+	if mongo.IsDuplicateKeyError(err) {
+		return errClusterExists
+	}
+	return err
+}
+
+func (s *mongoStore) deleteCluster(ctx context.Context, clusterID, projectID string) (bool, error) {
+	result, err := s.collection(mongoDBCollectionNameCluster).DeleteOne(ctx,
+		bson.M{"clusterid": clusterID, "projectid": projectID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *mongoStore) takeLock(ctx context.Context, lock runLock) (*runLock, error) {
+	lockCol := s.collection(mongoDBCollectionNameLock)
+	// an unexpired lock of another run does not match, so the upsert conflicts on _id
+	_, err := lockCol.UpdateOne(ctx, bson.M{"_id": runLockID, "expireAt": bson.M{"$lt": lock.AcquiredAt}},
+		bson.M{"$set": lock}, mongooptions.Update().SetUpsert(true))
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	holder := &runLock{}
+	if err = lockCol.FindOne(ctx, bson.M{"_id": runLockID}).Decode(holder); err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+func (s *mongoStore) removeLock(ctx context.Context) (*runLock, error) {
+	old := &runLock{}
+	err := s.collection(mongoDBCollectionNameLock).FindOneAndDelete(ctx, bson.M{"_id": runLockID}).Decode(old)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func (s *mongoStore) renewLock(ctx context.Context, owner string, now time.Time) (bool, error) {
+	result, err := s.collection(mongoDBCollectionNameLock).UpdateOne(ctx,
+		bson.M{"_id": runLockID, "owner": owner},
+		bson.M{"$set": bson.M{"heartbeat": now, "expireAt": now.Add(runLockTTL)}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *mongoStore) releaseLock(ctx context.Context, owner string) error {
+	_, err := s.collection(mongoDBCollectionNameLock).DeleteOne(ctx, bson.M{"_id": runLockID, "owner": owner})
+	return err
+}
+
+func (s *mongoStore) nextClusterNum(ctx context.Context, floor int) (int, error) {
+	counterCol := s.collection(mongoDBCollectionNameCounter)
+	filter := bson.M{"_id": clusterNumCounterID}
+	raise := bson.M{"$max": bson.M{"seq": floor}}
+	_, err := counterCol.UpdateOne(ctx, filter, raise, mongooptions.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// the counter was created concurrently, raise it again
+		_, err = counterCol.UpdateOne(ctx, filter, raise)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var counter struct {
+		Seq int `bson:"seq"`
+	}
+	err = counterCol.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"seq": 1}},
+		mongooptions.FindOneAndUpdate().SetReturnDocument(mongooptions.After)).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+func (s *mongoStore) ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+func (s *mongoStore) close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// DoVerify verify clusters are imported into cluster manager, the new bcs kube agent is ready and
+// clusters are reachable through it
+func (app *App) DoVerify(ctx context.Context) error {
+	err := app.initClients()
+	if err != nil {
+		return err
+	}
+	defer app.closeClients()
+
+	migrated, changedClusters, err := app.listMigratedClusters(ctx)
+	if err != nil {
+		return err
+	}
+	blog.Infof("got %d migrated clusters", len(migrated))
+
+	failedClusters := newClusterErrors()
+	if app.op.KubeAgent.Enable {
+		app.parallelize(ctx, len(migrated), func(ctx context.Context, i int) {
+			c := migrated[i]
+			if err := app.verifyCluster(ctx, c, changedClusters); err != nil {
+				failedClusters.add(c.ClusterID, err)
+			}
+		})
+	}
+
+	blog.Infof("verified %d clusters", len(migrated)-len(failedClusters.all()))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed := failedClusters.all(); len(failed) > 0 {
+		return fmt.Errorf("%d clusters failed to verify: %v", len(failed), failed)
+	}
+
+	return nil
+}
+
+// verifyCluster verify the new kube agent of cluster and record the result in report
+func (app *App) verifyCluster(ctx context.Context, c types.ClusterM, changedClusters *clusterIDMapping) error {
+	origin := changedClusters.origin(c.ClusterID)
+	err := verifyKubeAgent(ctx, app.clusterOption(origin), c, changedClusters)
+	if err != nil {
+		blog.Errorf("verify kube agent for cluster %s[%s] failed, %v", c.ClusterName, c.ClusterID, err)
+		app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseVerify, statusFailed,
+			err.Error())
+		return err
+	}
+	app.report.recordCluster(origin, c.ClusterID, c.ProjectID, c.ClusterName, phaseVerify, statusSuccess, "")
+	blog.Infof("verify kube agent for cluster %s[%s] success", c.ClusterName, c.ClusterID)
+	return nil
+}
+
+func verifyKubeAgent(ctx context.Context, op *options.UpgradeOption, cluster types.ClusterM,
+	changeClusters *clusterIDMapping) error {
+	config, err := generateRestConfig(ctx, op, cluster, changeClusters.origin(cluster.ClusterID))
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	vars := newManifestVars(op, cluster, changeClusters.origin(cluster.ClusterID))
+	agents, err := kubeAgentDeployments(ctx, op, config, clientset, vars)
+	if err != nil {
+		return err
+	}
+	if len(agents) == 0 {
+		return fmt.Errorf("new kube agent not found in namespace %s", op.KubeAgent.Namespace)
+	}
+	for _, agent := range agents {
+		if agent.Status.ReadyReplicas == 0 {
+			return fmt.Errorf("deployment %s/%s has no ready replicas", agent.Namespace, agent.Name)
+		}
+	}
+
+	return checkClusterReachable(ctx, op, cluster.ClusterID)
+}
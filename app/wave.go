@@ -0,0 +1,255 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// orderings of clusters in waves
+const (
+	waveOrderClusterID   = "cluster_id"
+	waveOrderName        = "name"
+	waveOrderNodeCount   = "node_count"
+	waveOrderEnvironment = "environment"
+)
+
+// environmentRank clusters of test environments are migrated before prod ones
+var environmentRank = map[string]int{"debug": 0, "stag": 1, "prod": 2}
+
+// rolloutWaves migrate clusters wave by wave, every wave is migrated, deployed and verified before the next
+// one starts and a failed wave stops the rollout
+func (app *App) rolloutWaves(ctx context.Context, clusters []types.Cluster, snapshot *clusterSnapshot,
+	changedClusters *clusterIDMapping) error {
+	waves, err := splitWaves(app.op.Wave, clusters)
+	if err != nil {
+		return err
+	}
+	blog.Infof("will migrate %d clusters in %d waves", len(clusters), len(waves))
+	prompt := newPrompter(os.Stdin, os.Stderr)
+
+	for i, wave := range waves {
+		name := app.waveName(i)
+		blog.Infof("start %s with %d clusters: %v", name, len(wave), originClusterIDs(wave))
+		succeeded, failed := app.runWave(ctx, wave, snapshot, changedClusters)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		blog.Infof("%s finished, %d clusters succeeded, %d clusters failed: %v", name, len(succeeded),
+			len(failed), clusterIDsOf(failed))
+
+		err = checkWave(app.op.Wave, len(succeeded), len(failed))
+		app.report.recordWave(name, originClusterIDs(wave), len(succeeded), clusterIDsOf(failed), err)
+		if err != nil {
+			return fmt.Errorf("%s failed, rollout stopped, %v", name, err)
+		}
+		if i == len(waves)-1 || !app.op.Wave.Pause || app.op.DryRun {
+			continue
+		}
+		if err = prompt.confirmWave(ctx, app.waveName(i+1), len(waves[i+1])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runWave migrate clusters of a wave, deploy bcs components on them and verify the new kube agent, errors of
+// failed clusters are keyed by clusterID
+func (app *App) runWave(ctx context.Context, clusters []types.Cluster, snapshot *clusterSnapshot,
+	changedClusters *clusterIDMapping) ([]types.ClusterM, map[string]string) {
+	migrated, failed := app.migrateClusters(ctx, clusters, snapshot, changedClusters)
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+	failedClusters := newClusterErrors()
+	for _, c := range failed {
+		failedClusters.add(c.ClusterID, fmt.Errorf("migrate cluster failed"))
+	}
+
+	deployed := make([]types.ClusterM, 0, len(migrated))
+	deployFailed := app.deployComponents(ctx, migrated, changedClusters)
+	for _, c := range migrated {
+		if msg, ok := deployFailed[c.ClusterID]; ok {
+			failedClusters.add(c.ClusterID, fmt.Errorf("%s", msg))
+			continue
+		}
+		deployed = append(deployed, c)
+	}
+	if ctx.Err() != nil || !app.op.KubeAgent.Enable || app.op.DryRun {
+		return deployed, failedClusters.all()
+	}
+
+	verified := newClusterErrors()
+	app.parallelize(ctx, len(deployed), func(ctx context.Context, i int) {
+		if err := app.verifyCluster(ctx, deployed[i], changedClusters); err != nil {
+			verified.add(deployed[i].ClusterID, err)
+		}
+	})
+	verifyFailed := verified.all()
+	succeeded := make([]types.ClusterM, 0, len(deployed))
+	for _, c := range deployed {
+		if msg, ok := verifyFailed[c.ClusterID]; ok {
+			failedClusters.add(c.ClusterID, fmt.Errorf("%s", msg))
+			continue
+		}
+		succeeded = append(succeeded, c)
+	}
+	return succeeded, failedClusters.all()
+}
+
+// checkWave check failed clusters of a wave against the failure budget and the success rate
+func checkWave(op options.Wave, succeeded, failed int) error {
+	if failed > op.FailureBudget {
+		return fmt.Errorf("%d clusters failed, exceeds failure budget %d", failed, op.FailureBudget)
+	}
+	total := succeeded + failed
+	if total > 0 && succeeded*100 < op.SuccessRate*total {
+		return fmt.Errorf("success rate %d%% is below %d%%", succeeded*100/total, op.SuccessRate)
+	}
+	return nil
+}
+
+// splitWaves order clusters and split them into the canary wave and waves of size, the rest of clusters
+// after the canary wave make up one wave if size is not set
+func splitWaves(op options.Wave, clusters []types.Cluster) ([][]types.Cluster, error) {
+	if op.CanarySize < 0 || op.Size < 0 || op.FailureBudget < 0 {
+		return nil, fmt.Errorf("wave.canary_size, wave.size and wave.failure_budget must not be negative")
+	}
+	if op.SuccessRate < 0 || op.SuccessRate > 100 {
+		return nil, fmt.Errorf("wave.success_rate must be between 0 and 100")
+	}
+
+	ordered := append([]types.Cluster(nil), clusters...)
+	switch op.OrderBy {
+	case "":
+	case waveOrderClusterID:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			ni, okI := parseClusterNum(ordered[i].ClusterID)
+			nj, okJ := parseClusterNum(ordered[j].ClusterID)
+			if okI && okJ {
+				return ni < nj
+			}
+			return ordered[i].ClusterID < ordered[j].ClusterID
+		})
+	case waveOrderName:
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Name < ordered[j].Name })
+	case waveOrderNodeCount:
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].NodeCount < ordered[j].NodeCount })
+	case waveOrderEnvironment:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return envRank(ordered[i].Environment) < envRank(ordered[j].Environment)
+		})
+	default:
+		return nil, fmt.Errorf("unknown wave.order_by %s", op.OrderBy)
+	}
+
+	waves := make([][]types.Cluster, 0)
+	if op.CanarySize > 0 && len(ordered) > 0 {
+		n := op.CanarySize
+		if n > len(ordered) {
+			n = len(ordered)
+		}
+		waves = append(waves, ordered[:n])
+		ordered = ordered[n:]
+	}
+	size := op.Size
+	if size == 0 {
+		size = len(ordered)
+	}
+	for len(ordered) > 0 {
+		n := size
+		if n > len(ordered) {
+			n = len(ordered)
+		}
+		waves = append(waves, ordered[:n])
+		ordered = ordered[n:]
+	}
+	return waves, nil
+}
+
+func envRank(env string) int {
+	if rank, ok := environmentRank[env]; ok {
+		return rank
+	}
+	return len(environmentRank)
+}
+
+// waveName the first wave is the canary one if canary_size is set
+func (app *App) waveName(i int) string {
+	if app.op.Wave.CanarySize > 0 {
+		if i == 0 {
+			return "canary wave"
+		}
+		return fmt.Sprintf("wave %d", i)
+	}
+	return fmt.Sprintf("wave %d", i+1)
+}
+
+// prompter ask the operator to confirm on stdin, one reader is shared by all prompts of a rollout so that
+// answers piped in ahead are kept for later waves. A pending read can not be interrupted, when ctx is done
+// its goroutine exits at the next line or EOF of stdin
+type prompter struct {
+	reader  *bufio.Reader
+	out     io.Writer
+	answers chan string
+	pending bool
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{reader: bufio.NewReader(in), out: out, answers: make(chan string, 1)}
+}
+
+// confirmWave ask the operator to continue with the next wave, the prompt goes to stderr so that it is not
+// mixed with tables and reports on stdout
+func (p *prompter) confirmWave(ctx context.Context, name string, size int) error {
+	fmt.Fprintf(p.out, "continue with %s of %d clusters? [y/N]: ", name, size)
+	if !p.pending {
+		p.pending = true
+		go func() {
+			line, _ := p.reader.ReadString('\n')
+			p.answers <- strings.ToLower(strings.TrimSpace(line))
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case a := <-p.answers:
+		p.pending = false
+		if a == "y" || a == "yes" {
+			return nil
+		}
+		return fmt.Errorf("rollout stopped by operator before %s", name)
+	}
+}
+
+func originClusterIDs(clusters []types.Cluster) []string {
+	ids := make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		ids = append(ids, c.ClusterID)
+	}
+	return ids
+}
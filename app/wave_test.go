@@ -0,0 +1,128 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+func TestSplitWaves(t *testing.T) {
+	clusters := []types.Cluster{
+		{ClusterID: "BCS-K8S-15010", Name: "c", Environment: "prod", NodeCount: 5},
+		{ClusterID: "BCS-K8S-15002", Name: "a", Environment: "stag", NodeCount: 1},
+		{ClusterID: "BCS-K8S-15100", Name: "b", Environment: "debug", NodeCount: 3},
+		{ClusterID: "BCS-K8S-15001", Name: "d", Environment: "prod", NodeCount: 2},
+	}
+	tests := []struct {
+		name    string
+		op      options.Wave
+		want    [][]string
+		wantErr bool
+	}{
+		{"one wave", options.Wave{},
+			[][]string{{"BCS-K8S-15010", "BCS-K8S-15002", "BCS-K8S-15100", "BCS-K8S-15001"}}, false},
+		{"canary and the rest", options.Wave{CanarySize: 1, OrderBy: waveOrderClusterID},
+			[][]string{{"BCS-K8S-15001"}, {"BCS-K8S-15002", "BCS-K8S-15010", "BCS-K8S-15100"}}, false},
+		{"canary and size", options.Wave{CanarySize: 1, Size: 2, OrderBy: waveOrderName},
+			[][]string{{"BCS-K8S-15002"}, {"BCS-K8S-15100", "BCS-K8S-15010"}, {"BCS-K8S-15001"}}, false},
+		{"node count", options.Wave{Size: 3, OrderBy: waveOrderNodeCount},
+			[][]string{{"BCS-K8S-15002", "BCS-K8S-15001", "BCS-K8S-15100"}, {"BCS-K8S-15010"}}, false},
+		{"environment", options.Wave{Size: 2, OrderBy: waveOrderEnvironment},
+			[][]string{{"BCS-K8S-15100", "BCS-K8S-15002"}, {"BCS-K8S-15010", "BCS-K8S-15001"}}, false},
+		{"canary larger than clusters", options.Wave{CanarySize: 10},
+			[][]string{{"BCS-K8S-15010", "BCS-K8S-15002", "BCS-K8S-15100", "BCS-K8S-15001"}}, false},
+		{"unknown order", options.Wave{OrderBy: "age"}, nil, true},
+		{"negative size", options.Wave{Size: -1}, nil, true},
+		{"success rate over 100", options.Wave{SuccessRate: 101}, nil, true},
+	}
+	for _, tt := range tests {
+		waves, err := splitWaves(tt.op, clusters)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var got [][]string
+		for _, wave := range waves {
+			got = append(got, originClusterIDs(wave))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: waves %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if clusters[0].ClusterID != "BCS-K8S-15010" {
+		t.Error("clusters are reordered in place")
+	}
+}
+
+func TestCheckWave(t *testing.T) {
+	tests := []struct {
+		name      string
+		op        options.Wave
+		succeeded int
+		failed    int
+		wantErr   bool
+	}{
+		{"all succeeded", options.Wave{}, 3, 0, false},
+		{"within budget", options.Wave{FailureBudget: 1}, 3, 1, false},
+		{"over budget", options.Wave{FailureBudget: 1}, 3, 2, true},
+		{"success rate met", options.Wave{FailureBudget: 10, SuccessRate: 75}, 3, 1, false},
+		{"success rate missed", options.Wave{FailureBudget: 10, SuccessRate: 80}, 3, 1, true},
+		{"empty wave", options.Wave{SuccessRate: 100}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		if err := checkWave(tt.op, tt.succeeded, tt.failed); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPrompter(t *testing.T) {
+	out := &bytes.Buffer{}
+	// answers piped in ahead are kept for later waves
+	p := newPrompter(strings.NewReader("y\nYes\nn\n"), out)
+	ctx := context.Background()
+	for i, wantErr := range []bool{false, false, true, true} {
+		if err := p.confirmWave(ctx, "wave", 1); (err != nil) != wantErr {
+			t.Errorf("answer %d: err %v, want error %v", i, err, wantErr)
+		}
+	}
+	if !strings.Contains(out.String(), "continue with wave of 1 clusters?") {
+		t.Errorf("unexpected prompt %q", out.String())
+	}
+
+	// a cancelled prompt returns at once and the pending read is answered by the next line
+	r, w := io.Pipe()
+	p = newPrompter(r, io.Discard)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := p.confirmWave(cancelled, "wave", 1); err != context.Canceled {
+		t.Errorf("cancelled prompt: err %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte("y\n"))
+	}()
+	if err := p.confirmWave(ctx, "wave", 1); err != nil {
+		t.Errorf("answer after cancel: err %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+const (
+	defaultWorkers        = 1
+	defaultClusterTimeout = 10 * time.Minute
+)
+
+// parallelize call fn for index 0 to n-1 with at most op.Workers goroutines, every call gets its own
+// timeout of op.ClusterTimeout, indexes not started yet are skipped once ctx is cancelled
+func (app *App) parallelize(ctx context.Context, n int, fn func(ctx context.Context, i int)) {
+	workers := app.op.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	timeout := time.Duration(app.op.ClusterTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultClusterTimeout
+	}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				clusterCtx, cancel := context.WithTimeout(ctx, timeout)
+				fn(clusterCtx, i)
+				cancel()
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+			blog.Warnf("context cancelled, %d of %d items not started, %v", n-i, n, ctx.Err())
+			i = n
+		case indexes <- i:
+		}
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// clusterIDMapping new clusterID to clusterID in 1.18, safe for concurrent use
+type clusterIDMapping struct {
+	lock sync.RWMutex
+	ids  map[string]string
+}
+
+func newClusterIDMapping() *clusterIDMapping {
+	return &clusterIDMapping{ids: make(map[string]string, 0)}
+}
+
+// set record clusterID changed from originClusterID
+func (m *clusterIDMapping) set(clusterID, originClusterID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.ids[clusterID] = originClusterID
+}
+
+// origin get clusterID in 1.18 of the cluster
+func (m *clusterIDMapping) origin(clusterID string) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if value, ok := m.ids[clusterID]; ok {
+		return value
+	}
+	return clusterID
+}
+
+// all get a copy of all changed clusterIDs
+func (m *clusterIDMapping) all() map[string]string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ids := make(map[string]string, len(m.ids))
+	for k, v := range m.ids {
+		ids[k] = v
+	}
+	return ids
+}
+
+// clusterResults success, failed and duplicated clusters of migration, safe for concurrent use
+type clusterResults struct {
+	lock    sync.Mutex
+	success []types.ClusterM
+	failed  []types.ClusterM
+	dup     []types.ClusterM
+}
+
+func (r *clusterResults) addSuccess(c types.ClusterM) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.success = append(r.success, c)
+}
+
+func (r *clusterResults) addFailed(c types.ClusterM) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failed = append(r.failed, c)
+}
+
+func (r *clusterResults) addDup(c types.ClusterM) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dup = append(r.dup, c)
+}
+
+// clusterErrors errors of clusters keyed by clusterID, safe for concurrent use
+type clusterErrors struct {
+	lock sync.Mutex
+	errs map[string]string
+}
+
+func newClusterErrors() *clusterErrors {
+	return &clusterErrors{errs: make(map[string]string, 0)}
+}
+
+func (e *clusterErrors) add(clusterID string, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.errs[clusterID] = err.Error()
+}
+
+// all get a copy of all cluster errors
+func (e *clusterErrors) all() map[string]string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	errs := make(map[string]string, len(e.errs))
+	for k, v := range e.errs {
+		errs[k] = v
+	}
+	return errs
+}
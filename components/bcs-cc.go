@@ -14,13 +14,10 @@
 package components
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"net/http"
 
-	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
-	"github.com/parnurzeal/gorequest"
-
 	"github.com/Tencent/bk-bcs/install/upgradetool/options"
 	"github.com/Tencent/bk-bcs/install/upgradetool/types"
 )
@@ -199,112 +196,100 @@ type NodeListUpdateResponse struct {
 	Result bool   `json:"result"`
 }
 
-// GetAccessToken get access token
-func GetAccessToken(cc options.BCSCc, debug bool) (*AccessTokenResponse, error) {
-	resp := &AccessTokenResponse{}
-	req := &AccessTokenReq{
-		GrantType:  "client_credentials",
-		IdProvider: "client",
-	}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Post(fmt.Sprintf("%s/api/v1/auth/access-tokens", cc.SsmHost)).
-		Set("Content-Type", "application/json").
-		Set("X-BK-APP-CODE", cc.AppCode).
-		Set("X-BK-APP-SECRET", cc.AppSecret).
-		Send(req).
-		EndStruct(resp)
+// BCSCc client of bcs cc, calls of bcs cc take the access token got from bkssm
+type BCSCc interface {
+	// GetAccessToken get access token from bkssm
+	GetAccessToken(ctx context.Context) (*AccessTokenResponse, error)
+	// SyncClusterToCc sync cluster to bcs cc
+	SyncClusterToCc(ctx context.Context, projectID, token string, req *SyncClusterReq) (*SyncClusterResponse, error)
+	// UpdateCluster update cluster in bcs cc
+	UpdateCluster(ctx context.Context, projectID, clusterID, token string, req *ClusterParamsRequest) error
+	// UpdateNodeList update node list
+	UpdateNodeList(ctx context.Context, projectID, token string, req *NodeListUpdateDataJSON) error
+}
 
-	if len(errs) > 0 {
-		blog.Errorf("call bkssm api failed: %v", errs[0])
-		return nil, errs[0]
-	}
+type bcsCc struct {
+	conf options.BCSCc
+	ssm  client
+	cc   client
+}
 
-	if result.StatusCode != http.StatusOK || resp.Code != 0 {
-		errMsg := fmt.Errorf("call bkssm api error: code[%v], body[%v], err[%s]",
-			result.StatusCode, string(body), resp.Message)
-		return nil, errMsg
+// NewBCSCc client of bcs cc and bkssm
+func NewBCSCc(cc options.BCSCc, debug bool, retry options.Retry) BCSCc {
+	return &bcsCc{
+		conf: cc,
+		ssm:  newClient("bkssm", debug, retry),
+		cc:   newClient("bcs cc", debug, retry),
 	}
+}
 
+// GetAccessToken get access token
+func (c *bcsCc) GetAccessToken(ctx context.Context) (*AccessTokenResponse, error) {
+	resp := &AccessTokenResponse{}
+	err := c.ssm.do(ctx, &request{
+		method: http.MethodPost,
+		url:    fmt.Sprintf("%s/api/v1/auth/access-tokens", c.conf.SsmHost),
+		header: map[string]string{
+			"Content-Type":    "application/json",
+			"X-BK-APP-CODE":   c.conf.AppCode,
+			"X-BK-APP-SECRET": c.conf.AppSecret,
+		},
+		body: &AccessTokenReq{
+			GrantType:  "client_credentials",
+			IdProvider: "client",
+		},
+		resp:   resp,
+		status: func() (uint, string) { return uint(resp.Code), resp.Message },
+		// a new token is issued each time
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
 
 // SyncClusterToCc sync cluster to bcs cc
-func SyncClusterToCc(host, projectID, token string, debug bool, req *SyncClusterReq) (*SyncClusterResponse, error) {
+func (c *bcsCc) SyncClusterToCc(ctx context.Context, projectID, token string, req *SyncClusterReq) (
+	*SyncClusterResponse, error) {
 	resp := &SyncClusterResponse{}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Post(fmt.Sprintf("%s/projects/%s/clusters?access_token=%s", host, projectID, token)).
-		Set("Content-Type", "application/json").
-		Send(req).
-		EndStruct(resp)
-
-	if len(errs) > 0 {
-		blog.Errorf("call bcs cc api failed: %v", errs[0])
-		return nil, errs[0]
+	err := c.cc.do(ctx, &request{
+		method: http.MethodPost,
+		url:    fmt.Sprintf("%s/projects/%s/clusters?access_token=%s", c.conf.Addr, projectID, token),
+		header: map[string]string{"Content-Type": "application/json"},
+		body:   req,
+		resp:   resp,
+		status: func() (uint, string) { return resp.Code, resp.Message },
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	if result.StatusCode != http.StatusOK || resp.Code != 0 {
-		errMsg := fmt.Errorf("call bcs cc api error: code[%v], body[%v], err[%s]",
-			result.StatusCode, string(body), resp.Message)
-		return nil, errMsg
-	}
-
 	return resp, nil
 }
 
 // UpdateCluster update cluster in bcs cc
-func UpdateCluster(host, projectID, clusterID, token string, debug bool, req *ClusterParamsRequest) error {
+func (c *bcsCc) UpdateCluster(ctx context.Context, projectID, clusterID, token string,
+	req *ClusterParamsRequest) error {
 	resp := &CommonResp{}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Put(fmt.Sprintf("%s/projects/%s/clusters/%s?access_token=%s", host, projectID, clusterID, token)).
-		Set("Content-Type", "application/json").
-		Send(req).
-		EndStruct(resp)
-
-	if len(errs) > 0 {
-		blog.Errorf("call bcs cc api failed: %v", errs[0])
-		return errs[0]
-	}
-
-	if result.StatusCode != http.StatusOK || resp.Code != 0 {
-		errMsg := fmt.Errorf("call bcs cc api error: code[%v], body[%v], err[%s]",
-			result.StatusCode, string(body), resp.Message)
-		return errMsg
-	}
-
-	return nil
+	return c.cc.do(ctx, &request{
+		method: http.MethodPut,
+		url:    fmt.Sprintf("%s/projects/%s/clusters/%s?access_token=%s", c.conf.Addr, projectID, clusterID, token),
+		header: map[string]string{"Content-Type": "application/json"},
+		body:   req,
+		resp:   resp,
+		status: func() (uint, string) { return resp.Code, resp.Message },
+	})
 }
 
 // UpdateNodeList update node list
-func UpdateNodeList(host, projectID, token string, debug bool, req *NodeListUpdateDataJSON) error {
+func (c *bcsCc) UpdateNodeList(ctx context.Context, projectID, token string, req *NodeListUpdateDataJSON) error {
 	resp := &NodeListUpdateResponse{}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Put(fmt.Sprintf("%s/projects/%s?access_token=%s", host, projectID, token)).
-		Set("Content-Type", "application/json").
-		Send(req).
-		EndStruct(resp)
-
-	if len(errs) > 0 {
-		blog.Errorf("call bcs cc api failed: %v", errs[0])
-		return errs[0]
-	}
-
-	if result.StatusCode != http.StatusOK || resp.Code != 0 {
-		errMsg := fmt.Errorf("call bcs cc api error: code[%v], body[%v], err[%s]",
-			result.StatusCode, string(body), resp.Message)
-		return errMsg
-	}
-
-	return nil
+	return c.cc.do(ctx, &request{
+		method: http.MethodPut,
+		url:    fmt.Sprintf("%s/projects/%s?access_token=%s", c.conf.Addr, projectID, token),
+		header: map[string]string{"Content-Type": "application/json"},
+		body:   req,
+		resp:   resp,
+		status: func() (uint, string) { return resp.Code, resp.Message },
+	})
 }
@@ -0,0 +1,157 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package components
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+	"github.com/Tencent/bk-bcs/install/upgradetool/types"
+)
+
+// CreateClusterRequest create cluster request, only the cluster info is created when OnlyCreateInfo is true
+type CreateClusterRequest struct {
+	ClusterID              string                       `json:"clusterID,omitempty"`
+	ClusterName            string                       `json:"clusterName,omitempty"`
+	Provider               string                       `json:"provider,omitempty"`
+	Region                 string                       `json:"region,omitempty"`
+	VpcID                  string                       `json:"vpcID,omitempty"`
+	ProjectID              string                       `json:"projectID,omitempty"`
+	BusinessID             string                       `json:"businessID,omitempty"`
+	Environment            string                       `json:"environment,omitempty"`
+	EngineType             string                       `json:"engineType,omitempty"`
+	IsExclusive            bool                         `json:"isExclusive,omitempty"`
+	ClusterType            string                       `json:"clusterType,omitempty"`
+	Labels                 map[string]string            `json:"labels,omitempty"`
+	Creator                string                       `json:"creator,omitempty"`
+	OnlyCreateInfo         bool                         `json:"onlyCreateInfo,omitempty"`
+	ManageType             string                       `json:"manageType,omitempty"`
+	Master                 []string                     `json:"master,omitempty"`
+	NetworkSettings        *types.NetworkSetting        `json:"networkSettings,omitempty"`
+	ClusterBasicSettings   *types.ClusterBasicSetting   `json:"clusterBasicSettings,omitempty"`
+	ClusterAdvanceSettings *types.ClusterAdvanceSetting `json:"clusterAdvanceSettings,omitempty"`
+	NodeSettings           *types.NodeSetting           `json:"nodeSettings,omitempty"`
+	NetworkType            string                       `json:"networkType,omitempty"`
+	ExtraInfo              map[string]string            `json:"extraInfo,omitempty"`
+	ExtraClusterID         string                       `json:"extraClusterID,omitempty"`
+	IsCommonCluster        bool                         `json:"isCommonCluster,omitempty"`
+	Description            string                       `json:"description,omitempty"`
+	ClusterCategory        string                       `json:"clusterCategory,omitempty"`
+	IsShared               bool                         `json:"is_shared,omitempty"`
+}
+
+// ClusterManagerResponse response of cluster manager
+type ClusterManagerResponse struct {
+	Code    uint32          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Result  bool            `json:"result,omitempty"`
+	Data    *types.ClusterM `json:"data,omitempty"`
+}
+
+// NewCreateClusterRequest request importing the cluster info as it is into cluster manager
+func NewCreateClusterRequest(cluster *types.ClusterM) *CreateClusterRequest {
+	masters := make([]string, 0, len(cluster.Master))
+	for ip := range cluster.Master {
+		masters = append(masters, ip)
+	}
+	sort.Strings(masters)
+
+	return &CreateClusterRequest{
+		ClusterID:              cluster.ClusterID,
+		ClusterName:            cluster.ClusterName,
+		Provider:               cluster.Provider,
+		Region:                 cluster.Region,
+		VpcID:                  cluster.VpcID,
+		ProjectID:              cluster.ProjectID,
+		BusinessID:             cluster.BusinessID,
+		Environment:            cluster.Environment,
+		EngineType:             cluster.EngineType,
+		IsExclusive:            cluster.IsExclusive,
+		ClusterType:            cluster.ClusterType,
+		Labels:                 cluster.Labels,
+		Creator:                cluster.Creator,
+		OnlyCreateInfo:         true,
+		ManageType:             cluster.ManageType,
+		Master:                 masters,
+		NetworkSettings:        cluster.NetworkSettings,
+		ClusterBasicSettings:   cluster.ClusterBasicSettings,
+		ClusterAdvanceSettings: cluster.ClusterAdvanceSettings,
+		NodeSettings:           cluster.NodeSettings,
+		NetworkType:            cluster.NetworkType,
+		ExtraInfo:              cluster.ExtraInfo,
+		ExtraClusterID:         cluster.ExtraClusterID,
+		IsCommonCluster:        cluster.IsCommonCluster,
+		Description:            cluster.Description,
+		ClusterCategory:        cluster.ClusterCategory,
+		IsShared:               cluster.IsShared,
+	}
+}
+
+// ClusterManager client of bcs cluster manager
+type ClusterManager interface {
+	// CreateCluster create cluster, ErrAlreadyExists is returned if the clusterID is taken
+	CreateCluster(ctx context.Context, req *CreateClusterRequest) (*ClusterManagerResponse, error)
+	// DeleteCluster delete the cluster info, nodes and cloud resources are kept. ErrNotFound is returned if
+	// the cluster does not exist
+	DeleteCluster(ctx context.Context, clusterID string) error
+}
+
+type clusterManager struct {
+	client
+	host  string
+	token string
+}
+
+// NewClusterManager client of bcs cluster manager behind bcs api gateway
+func NewClusterManager(host, token string, debug bool, retry options.Retry) ClusterManager {
+	return &clusterManager{
+		client: newClient("bcs cluster manager", debug, retry),
+		host:   host,
+		token:  token,
+	}
+}
+
+// CreateCluster create cluster
+func (c *clusterManager) CreateCluster(ctx context.Context, req *CreateClusterRequest) (
+	*ClusterManagerResponse, error) {
+	resp := &ClusterManagerResponse{}
+	err := c.do(ctx, &request{
+		method: http.MethodPost,
+		url:    fmt.Sprintf("%s/bcsapi/v4/clustermanager/v1/cluster", c.host),
+		header: bearer(c.token),
+		body:   req,
+		resp:   resp,
+		status: func() (uint, string) { return uint(resp.Code), resp.Message },
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DeleteCluster delete cluster
+func (c *clusterManager) DeleteCluster(ctx context.Context, clusterID string) error {
+	resp := &ClusterManagerResponse{}
+	return c.do(ctx, &request{
+		method: http.MethodDelete,
+		url: fmt.Sprintf("%s/bcsapi/v4/clustermanager/v1/cluster/%s?onlyDeleteInfo=true&instanceDeleteMode=retain",
+			c.host, clusterID),
+		header: bearer(c.token),
+		resp:   resp,
+		status: func() (uint, string) { return uint(resp.Code), resp.Message },
+	})
+}
@@ -14,13 +14,13 @@
 package components
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"net/http"
 
-	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
 	_struct "github.com/golang/protobuf/ptypes/struct"
-	"github.com/parnurzeal/gorequest"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
 )
 
 // CreateProjectRequest create project request
@@ -87,28 +87,54 @@ type Perms struct {
 	Perms *_struct.Struct `json:"perms,omitempty"`
 }
 
-// CreateProject create project
-func CreateProject(host, token string, debug bool, req *CreateProjectRequest) (*ProjectResponse, error) {
-	resp := &ProjectResponse{}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Post(fmt.Sprintf("%s/bcsapi/v4/bcsproject/v1/projects", host)).
-		Set("Authorization", fmt.Sprintf("Bearer %s", token)).
-		Send(req).
-		EndStruct(resp)
+// ProjectManager client of bcs project manager
+type ProjectManager interface {
+	// CreateProject create project, ErrAlreadyExists is returned if it exists
+	CreateProject(ctx context.Context, req *CreateProjectRequest) (*ProjectResponse, error)
+	// DeleteProject delete project
+	DeleteProject(ctx context.Context, projectID string) error
+}
 
-	if len(errs) > 0 {
-		blog.Errorf("call bcs project manager api failed: %v", errs[0])
-		return nil, errs[0]
-	}
+type projectManager struct {
+	client
+	host  string
+	token string
+}
 
-	if result.StatusCode != http.StatusOK || resp.Code != 0 {
-		errMsg := fmt.Errorf("call bcs project manager api error: code[%v], body[%v], err[%s]",
-			result.StatusCode, string(body), resp.Message)
-		return nil, errMsg
+// NewProjectManager client of bcs project manager behind bcs api gateway
+func NewProjectManager(host, token string, debug bool, retry options.Retry) ProjectManager {
+	return &projectManager{
+		client: newClient("bcs project manager", debug, retry),
+		host:   host,
+		token:  token,
 	}
+}
 
+// CreateProject create project
+func (c *projectManager) CreateProject(ctx context.Context, req *CreateProjectRequest) (*ProjectResponse, error) {
+	resp := &ProjectResponse{}
+	err := c.do(ctx, &request{
+		method: http.MethodPost,
+		url:    fmt.Sprintf("%s/bcsapi/v4/bcsproject/v1/projects", c.host),
+		header: bearer(c.token),
+		body:   req,
+		resp:   resp,
+		status: func() (uint, string) { return uint(resp.Code), resp.Message },
+	})
+	if err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
+
+// DeleteProject delete project
+func (c *projectManager) DeleteProject(ctx context.Context, projectID string) error {
+	resp := &ProjectResponse{}
+	return c.do(ctx, &request{
+		method: http.MethodDelete,
+		url:    fmt.Sprintf("%s/bcsapi/v4/bcsproject/v1/projects/%s", c.host, projectID),
+		header: bearer(c.token),
+		resp:   resp,
+		status: func() (uint, string) { return uint(resp.Code), resp.Message },
+	})
+}
@@ -14,12 +14,12 @@
 package components
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
+	"net/http"
 	"time"
 
-	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
-	"github.com/parnurzeal/gorequest"
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
 )
 
 const defaultTimeOut = time.Second * 60
@@ -41,52 +41,56 @@ type ClusterCredentialResp struct {
 	CaCert     string `json:"cacert_data"`
 }
 
-// GetClusterIdentifier cluster identifier
-func GetClusterIdentifier(host, token, projectID, clusterID string, debug bool) (*IdentifierResp, error) {
-	resp := &IdentifierResp{}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Get(fmt.Sprintf("%s/rest/clusters/bcs/query_by_id?project_id=%s&cluster_id=%s", host, projectID, clusterID)).
-		Set("Authorization", fmt.Sprintf("Bearer %s", token)).
-		EndStruct(resp)
+// BCSApi client of bcs api in 1.18
+type BCSApi interface {
+	// GetClusterIdentifier get identifier of cluster in bcs api
+	GetClusterIdentifier(ctx context.Context, projectID, clusterID string) (*IdentifierResp, error)
+	// GetClusterCredential get credential of cluster by its identifier id
+	GetClusterCredential(ctx context.Context, id string) (*ClusterCredentialResp, error)
+}
 
-	if len(errs) > 0 {
-		blog.Errorf("call BCS API failed: %v", errs[0])
-		return nil, errs[0]
-	}
+type bcsAPI struct {
+	client
+	host  string
+	token string
+}
 
-	if result.StatusCode != 200 {
-		errMsg := fmt.Errorf("call BCS API error: code[%d], %s",
-			result.StatusCode, string(body))
-		return nil, errMsg
+// NewBCSApi client of bcs api in 1.18
+func NewBCSApi(host, token string, debug bool, retry options.Retry) BCSApi {
+	return &bcsAPI{
+		client: newClient("bcs", debug, retry),
+		host:   host,
+		token:  token,
 	}
+}
 
+// GetClusterIdentifier cluster identifier
+func (c *bcsAPI) GetClusterIdentifier(ctx context.Context, projectID, clusterID string) (*IdentifierResp, error) {
+	resp := &IdentifierResp{}
+	err := c.do(ctx, &request{
+		method: http.MethodGet,
+		url: fmt.Sprintf("%s/rest/clusters/bcs/query_by_id?project_id=%s&cluster_id=%s", c.host, projectID,
+			clusterID),
+		header: bearer(c.token),
+		resp:   resp,
+	})
+	if err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
 
 // GetClusterCredential get cluster credential
-func GetClusterCredential(host, token, id string, debug bool) (*ClusterCredentialResp, error) {
+func (c *bcsAPI) GetClusterCredential(ctx context.Context, id string) (*ClusterCredentialResp, error) {
 	resp := &ClusterCredentialResp{}
-	result, body, errs := gorequest.New().
-		Timeout(defaultTimeOut).
-		SetDebug(debug).
-		TLSClientConfig(&tls.Config{InsecureSkipVerify: true}).
-		Get(fmt.Sprintf("%s/rest/clusters/%s/client_credentials", host, id)).
-		Set("Authorization", fmt.Sprintf("Bearer %s", token)).
-		EndStruct(resp)
-
-	if len(errs) > 0 {
-		blog.Errorf("call BCS API failed: %v", errs[0])
-		return nil, errs[0]
+	err := c.do(ctx, &request{
+		method: http.MethodGet,
+		url:    fmt.Sprintf("%s/rest/clusters/%s/client_credentials", c.host, id),
+		header: bearer(c.token),
+		resp:   resp,
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	if result.StatusCode != 200 {
-		errMsg := fmt.Errorf("call BCS API error: code[%d], %s",
-			result.StatusCode, string(body))
-		return nil, errMsg
-	}
-
 	return resp, nil
 }
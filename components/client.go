@@ -0,0 +1,314 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package components
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
+	"github.com/parnurzeal/gorequest"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+// kinds of api errors, check them with errors.Is
+var (
+	ErrAlreadyExists = errors.New("already exists")
+	ErrNotFound      = errors.New("not found")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrTransient     = errors.New("transient error")
+)
+
+// IsAlreadyExists the object to create already exists
+func IsAlreadyExists(err error) bool {
+	return errors.Is(err, ErrAlreadyExists)
+}
+
+// IsNotFound the object is not found
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsUnauthorized the token or app secret is rejected
+func IsUnauthorized(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
+
+// IsTransient the call may succeed if retried
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+// default retries of transient errors
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryInterval    = time.Second
+	defaultRetryMaxInterval = 30 * time.Second
+)
+
+// APIError error of an api call, it wraps the kind of error if the kind is recognized
+type APIError struct {
+	API        string
+	StatusCode int
+	Code       uint
+	Message    string
+	Body       string
+	Kind       error
+	Err        error
+}
+
+// Error xxx, secrets in urls and bodies are redacted
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return options.Redact(fmt.Sprintf("call %s api failed: %v", e.API, e.Err))
+	}
+	return options.Redact(fmt.Sprintf("call %s api error: code[%v], body[%v], err[%s]", e.API, e.StatusCode, e.Body,
+		e.Message))
+}
+
+// Unwrap the kind of error
+func (e *APIError) Unwrap() error {
+	return e.Kind
+}
+
+// classify kind of error by http status, and by message in response body for apis answering 200 on errors
+func classify(statusCode int, message string) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case statusCode == http.StatusNotFound:
+		return ErrNotFound
+	case statusCode == http.StatusConflict:
+		return ErrAlreadyExists
+	case statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError:
+		return ErrTransient
+	}
+
+	message = strings.ToLower(message)
+	switch {
+	case strings.Contains(message, "already exist") || strings.Contains(message, "duplicate"):
+		return ErrAlreadyExists
+	case strings.Contains(message, "not found") || strings.Contains(message, "not exist"):
+		return ErrNotFound
+	case strings.Contains(message, "unauthorized") || strings.Contains(message, "permission denied"):
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// request a call of api, resp is decoded from the response body and status gets the code and message in it,
+// status is nil for apis only answering http status. idempotent marks a POST that is safe to send twice
+type request struct {
+	method     string
+	url        string
+	header     map[string]string
+	body       interface{}
+	resp       interface{}
+	status     func() (uint, string)
+	idempotent bool
+}
+
+// retryable whether r can be sent again after a transient error, a POST timing out may have been done by the
+// server and a retry would see it as already existing
+func (r *request) retryable() bool {
+	switch r.method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return r.idempotent
+}
+
+// resetResp zero resp so that fields decoded by a failed attempt are not mixed into the next one
+func (r *request) resetResp() {
+	if r.resp == nil {
+		return
+	}
+	v := reflect.ValueOf(r.resp)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+}
+
+// debugLogger logger of http debug dumps, secrets in them are redacted before logging
+type debugLogger struct {
+	prefix string
+}
+
+// SetPrefix xxx
+func (l *debugLogger) SetPrefix(prefix string) {
+	l.prefix = prefix
+}
+
+// Printf xxx
+func (l *debugLogger) Printf(format string, v ...interface{}) {
+	blog.Infof("%s%s", l.prefix, options.Redact(fmt.Sprintf(format, v...)))
+}
+
+// Println xxx
+func (l *debugLogger) Println(v ...interface{}) {
+	blog.Infof("%s%s", l.prefix, options.Redact(strings.TrimSuffix(fmt.Sprintln(v...), "\n")))
+}
+
+// httpClient sends requests of all apis, certificates of the old bcs services are not verified
+var httpClient = &http.Client{
+	Timeout: defaultTimeOut,
+	Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// client shared by clients of all apis, calls failed with transient errors are retried with backoff
+type client struct {
+	api   string
+	debug bool
+	retry options.Retry
+}
+
+func newClient(api string, debug bool, retry options.Retry) client {
+	return client{api: api, debug: debug, retry: retry}
+}
+
+// do send request until it succeeds, fails with a non transient error or runs out of attempts, requests not
+// retryable are sent once
+func (c client) do(ctx context.Context, r *request) error {
+	attempts := c.retry.Attempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	if !r.retryable() {
+		attempts = 1
+	}
+	interval := time.Duration(c.retry.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	maxInterval := time.Duration(c.retry.MaxInterval) * time.Second
+	if maxInterval <= 0 {
+		maxInterval = defaultRetryMaxInterval
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			blog.Warnf("%v, retry %d/%d in %s", err, i, attempts-1, interval)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+			interval *= 2
+			if interval > maxInterval {
+				interval = maxInterval
+			}
+		}
+		r.resetResp()
+		err = c.doOnce(ctx, r)
+		if !IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// doOnce send request once, gorequest only builds the request, which is sent with ctx so that a cancelled run or
+// an expired cluster deadline aborts calls in flight
+func (c client) doOnce(ctx context.Context, r *request) error {
+	agent := gorequest.New().CustomMethod(r.method, r.url)
+	for k, v := range r.header {
+		agent = agent.Set(k, v)
+	}
+	if r.body != nil {
+		agent = agent.Send(r.body)
+	}
+	if len(agent.Errors) > 0 {
+		return &APIError{API: c.api, Err: agent.Errors[0]}
+	}
+	httpReq, err := agent.MakeRequest()
+	if err != nil {
+		return &APIError{API: c.api, Err: err}
+	}
+	httpReq = httpReq.WithContext(ctx)
+	logger := &debugLogger{prefix: "[http] "}
+	if c.debug {
+		if dump, err := httputil.DumpRequest(httpReq, true); err == nil {
+			logger.Printf("HTTP Request: %s", string(dump))
+		}
+	}
+
+	result, err := httpClient.Do(httpReq)
+	// no response at all, e.g. connection refused or timeout
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		blog.Errorf("call %s api failed: %v", c.api, err)
+		return &APIError{API: c.api, Kind: ErrTransient, Err: err}
+	}
+	defer result.Body.Close()
+	if c.debug {
+		if dump, err := httputil.DumpResponse(result, true); err == nil {
+			logger.Printf("HTTP Response: %s", string(dump))
+		}
+	}
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &APIError{API: c.api, StatusCode: result.StatusCode, Kind: ErrTransient, Err: err}
+	}
+	var decodeErr error
+	if r.resp != nil {
+		decodeErr = json.Unmarshal(body, r.resp)
+	}
+
+	var (
+		code    uint
+		message string
+	)
+	if r.status != nil {
+		code, message = r.status()
+	}
+	if result.StatusCode == http.StatusOK && code == 0 {
+		if decodeErr != nil {
+			return &APIError{API: c.api, StatusCode: result.StatusCode, Body: string(body), Err: decodeErr}
+		}
+		return nil
+	}
+
+	return &APIError{
+		API:        c.api,
+		StatusCode: result.StatusCode,
+		Code:       code,
+		Message:    message,
+		Body:       string(body),
+		Kind:       classify(result.StatusCode, message),
+	}
+}
+
+// bearer authorization header of token
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": fmt.Sprintf("Bearer %s", token)}
+}
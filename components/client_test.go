@@ -0,0 +1,133 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package components
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tencent/bk-bcs/install/upgradetool/options"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		message    string
+		want       error
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", ErrUnauthorized},
+		{"forbidden", http.StatusForbidden, "", ErrUnauthorized},
+		{"not found", http.StatusNotFound, "", ErrNotFound},
+		{"conflict", http.StatusConflict, "", ErrAlreadyExists},
+		{"too many requests", http.StatusTooManyRequests, "", ErrTransient},
+		{"server error", http.StatusBadGateway, "cluster already exists", ErrTransient},
+		{"already exists in body", http.StatusOK, "Cluster Already Exists", ErrAlreadyExists},
+		{"duplicate in body", http.StatusOK, "duplicate key", ErrAlreadyExists},
+		{"not exist in body", http.StatusOK, "project does not exist", ErrNotFound},
+		{"permission denied in body", http.StatusOK, "permission denied", ErrUnauthorized},
+		{"bad request", http.StatusBadRequest, "invalid param", nil},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.statusCode, tt.message); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		method     string
+		idempotent bool
+		want       bool
+	}{
+		{http.MethodGet, false, true},
+		{http.MethodPut, false, true},
+		{http.MethodDelete, false, true},
+		{http.MethodPost, false, false},
+		{http.MethodPost, true, true},
+		{http.MethodPatch, false, false},
+	}
+	for _, tt := range tests {
+		r := &request{method: tt.method, idempotent: tt.idempotent}
+		if got := r.retryable(); got != tt.want {
+			t.Errorf("%s idempotent %v: got %v, want %v", tt.method, tt.idempotent, got, tt.want)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		statuses     []int
+		wantAttempts int32
+		wantKind     error
+	}{
+		{"get retried", http.MethodGet, []int{http.StatusBadGateway, http.StatusOK}, 2, nil},
+		{"get out of attempts", http.MethodGet, []int{http.StatusBadGateway, http.StatusBadGateway}, 2,
+			ErrTransient},
+		{"post sent once", http.MethodPost, []int{http.StatusBadGateway, http.StatusOK}, 1, ErrTransient},
+		{"not found not retried", http.MethodGet, []int{http.StatusNotFound, http.StatusOK}, 1, ErrNotFound},
+	}
+	for _, tt := range tests {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(tt.statuses[n-1])
+			_, _ = w.Write([]byte(`{"code":0,"message":"ok","value":"v"}`))
+		}))
+
+		resp := &struct {
+			Value string `json:"value"`
+		}{}
+		c := newClient("test", false, options.Retry{Attempts: 2, Interval: 1})
+		err := c.do(context.Background(), &request{method: tt.method, url: server.URL, resp: resp})
+		server.Close()
+
+		if attempts != tt.wantAttempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, attempts, tt.wantAttempts)
+		}
+		if tt.wantKind == nil && (err != nil || resp.Value != "v") {
+			t.Errorf("%s: err %v, resp %+v", tt.name, err, resp)
+		}
+		if tt.wantKind != nil && (err == nil || !errors.Is(err, tt.wantKind)) {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.wantKind)
+		}
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c := newClient("test", false, options.Retry{Attempts: 5, Interval: 10})
+	start := time.Now()
+	err := c.do(ctx, &request{method: http.MethodGet, url: server.URL})
+	if err != context.DeadlineExceeded {
+		t.Errorf("err %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("retry is not aborted by context")
+	}
+}
@@ -14,11 +14,15 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/Tencent/bk-bcs/bcs-common/common/blog"
 	"github.com/Tencent/bk-bcs/bcs-common/common/conf"
+	"github.com/spf13/pflag"
 
 	application "github.com/Tencent/bk-bcs/install/upgradetool/app"
 	"github.com/Tencent/bk-bcs/install/upgradetool/options"
@@ -29,15 +33,30 @@ func main() {
 
 	op := &options.UpgradeOption{}
 	conf.Parse(op)
-	blog.Infof("conf %#v", op)
 
 	blog.InitLogs(op.LogConfig)
 	defer blog.CloseLogs()
 
+	// secrets are registered for redaction before anything is logged
+	if err := op.LoadSecrets(); err != nil {
+		blog.Errorf("load secrets failed, %v", err)
+		blog.CloseLogs()
+		// nolint
+		os.Exit(1)
+	}
+	blog.Infof("conf %#v", op.Redacted())
+
 	app := application.NewApp(op)
 
-	if err := app.DoMigrate(); err != nil {
-		blog.Errorf("DoMigrate failed, %v", err)
+	// cancel running clusters on interrupt, progress is kept in journal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// sub command is the first positional argument, e.g. ./cluster-migrate-tool plan -f conf.json
+	command := pflag.Arg(0)
+	if err := app.Run(ctx, command); err != nil {
+		blog.Errorf("run command %s failed, %v", command, err)
+		stop()
 		blog.CloseLogs()
 		// nolint
 		os.Exit(1)
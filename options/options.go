@@ -21,19 +21,110 @@ type UpgradeOption struct {
 	conf.LogConfig
 
 	Debug              bool        `json:"debug"`
+	DryRun             bool        `json:"dry_run" value:"false" usage:"show the changes migrate would make without changing anything"`
+	ForceUnlock        bool        `json:"force_unlock" value:"false" usage:"release the run lock held by another run before taking it"`
+	SkipPreflight      bool        `json:"skip_preflight" value:"false" usage:"migrate without checking endpoints, credentials and images first"`
 	ProjectIDs         []string    `json:"project_ids"`
+	Filter             Filter      `json:"filter"`
 	MigrateProjectData bool        `json:"migrate_project_data"`
 	MigrateClusterData bool        `json:"migrate_cluster_data"`
 	DSN                string      `json:"mysql_dsn"`
 	MongoDB            MongoDBConf `json:"mongoDB"`
+	JournalPath        string      `json:"journal_path"`
+	Report             ReportConf  `json:"report"`
+	Rollback           Rollback    `json:"rollback"`
+	Cleanup            Cleanup     `json:"cleanup"`
+	Workers            int         `json:"workers" value:"1" usage:"number of clusters migrated concurrently"`
+	ClusterTimeout     int         `json:"cluster_timeout" value:"600" usage:"timeout in seconds for migrating a cluster"`
+	RolloutTimeout     int         `json:"rollout_timeout"`
+	OverridesPath      string      `json:"overrides_path"`
+	ClusterWriteMode   string      `json:"cluster_write_mode"`
+	Retry              Retry       `json:"retry"`
+	Wave               Wave        `json:"wave"`
 
-	BCSApi        BCSConf   `json:"bcs_api"`
-	BCSApiGateway BCSConf   `json:"bcs_api_gateway"`
-	BCSCertName   string    `json:"bcs_cert_name"`
-	BKClusterID   string    `json:"bk_cluster_id"`
-	BCSCc         BCSCc     `json:"bcs_cc"`
-	KubeAgent     KubeAgent `json:"kube_agent"`
-	K8SWatch      K8SWatch  `json:"k8s_watch"`
+	BCSApi              BCSConf   `json:"bcs_api"`
+	BCSApiGateway       BCSConf   `json:"bcs_api_gateway"`
+	BCSCertName         string    `json:"bcs_cert_name"`
+	BKClusterID         string    `json:"bk_cluster_id"`
+	BKClusterKubeconfig string    `json:"bk_cluster_kubeconfig"`
+	BCSCc               BCSCc     `json:"bcs_cc"`
+	KubeAgent           KubeAgent `json:"kube_agent"`
+	K8SWatch            K8SWatch  `json:"k8s_watch"`
+}
+
+// Filter selectors of projects and clusters besides project_ids, empty selectors select all. Statuses default
+// to normal, Disabled is true or false and selects both enabled and disabled clusters if it is empty,
+// BusinessIDs are CCAppID of projects and NameRegex matches cluster names. Projects are limited to those with
+// selected clusters when any selector of clusters is set
+type Filter struct {
+	ExcludeProjectIDs []string `json:"exclude_project_ids"`
+	BusinessIDs       []uint   `json:"business_ids"`
+	ClusterIDs        []string `json:"cluster_ids"`
+	ExcludeClusterIDs []string `json:"exclude_cluster_ids"`
+	Environments      []string `json:"environments"`
+	Types             []string `json:"types"`
+	Disabled          string   `json:"disabled"`
+	States            []string `json:"states"`
+	Statuses          []string `json:"statuses"`
+	NameRegex         string   `json:"name_regex"`
+}
+
+// Wave wave rollout of migrate, clusters ordered by order_by (cluster_id, name, node_count or environment) are
+// migrated canary_size first and then size per wave. A wave fails and stops the rollout when more than
+// failure_budget clusters fail in it or its success rate in percent is below success_rate. Pause asks the
+// operator to confirm before every next wave, otherwise the rollout continues when a wave passes
+type Wave struct {
+	Enable        bool   `json:"enable"`
+	CanarySize    int    `json:"canary_size"`
+	Size          int    `json:"size"`
+	OrderBy       string `json:"order_by"`
+	FailureBudget int    `json:"failure_budget"`
+	SuccessRate   int    `json:"success_rate"`
+	Pause         bool   `json:"pause"`
+}
+
+// Retry retries of api calls failed with transient errors, attempts include the first call and the interval
+// in seconds doubles after every retry up to max_interval
+type Retry struct {
+	Attempts    int `json:"attempts"`
+	Interval    int `json:"interval"`
+	MaxInterval int `json:"max_interval"`
+}
+
+// Rollback rollback configuration, clusters and projects are taken from the journal unless report_path is set
+type Rollback struct {
+	ReportPath     string `json:"report_path"`
+	DeleteProjects bool   `json:"delete_projects"`
+}
+
+// Cleanup cleanup configuration, mode is scale or delete, old components are backed up into backup_dir
+// before they are scaled down or deleted
+type Cleanup struct {
+	Mode      string `json:"mode"`
+	BackupDir string `json:"backup_dir"`
+}
+
+// ClusterOverride parameters of a cluster in the overrides file, keyed by clusterID in 1.18, empty fields
+// keep the global ones. ClusterID forces the clusterID in cluster manager, Provider, Region, Environment and
+// BusinessID are set to the cluster imported into cluster manager and bcs cc
+type ClusterOverride struct {
+	Skip               bool   `json:"skip"`
+	ClusterID          string `json:"cluster_id"`
+	Provider           string `json:"provider"`
+	Region             string `json:"region"`
+	Environment        string `json:"environment"`
+	BusinessID         string `json:"business_id"`
+	GatewayIP          string `json:"gateway_ip"`
+	KubeAgentNamespace string `json:"kube_agent_namespace"`
+	KubeAgentImage     string `json:"kube_agent_image"`
+	// KubeAgentValues overrides kube_agent.values and kube_agent.cluster_values of the cluster
+	KubeAgentValues map[string]string `json:"kube_agent_values"`
+}
+
+// ReportConf report configuration, formats are json, csv and markdown
+type ReportConf struct {
+	Dir     string   `json:"dir"`
+	Formats []string `json:"formats"`
 }
 
 // BCSCc bcs cc
@@ -60,16 +151,34 @@ type MongoDBConf struct {
 	Password string `json:"password"`
 }
 
-// KubeAgent bcs kube agent configuration
+// KubeAgent bcs kube agent configuration, the agent is installed from the chart at helm_package_path as
+// release_name when it is set, otherwise from the Deployment at yaml_path
 type KubeAgent struct {
 	Enable          bool   `json:"enable"`
 	YamlPath        string `json:"yaml_path"`
 	HelmPackagePath string `json:"helm_package_path"`
+	ReleaseName     string `json:"release_name"`
 	Namespace       string `json:"namespace"`
-	ServiceAccount  string `json:"service_account"`
 	Image           string `json:"image"`
+	// ImageRepo and ServiceAccount are used when the old bcs-kube-agent is deleted by cleanup and not backed up
+	ImageRepo      string `json:"image_repo"`
+	ServiceAccount string `json:"service_account"`
+	// Values custom variables of yaml_path templates, ClusterValues overrides them for clusters keyed by
+	// clusterID in 1.18
+	Values        map[string]string            `json:"values"`
+	ClusterValues map[string]map[string]string `json:"cluster_values"`
 }
 
-// K8SWatch bcs k8s watch configuration
+// K8SWatch bcs k8s watch configuration, storage_addr is the bcs storage the new k8s watch reports to,
+// gateway_addr defaults to bcs_api_gateway.addr
 type K8SWatch struct {
+	Enable      bool   `json:"enable"`
+	YamlPath    string `json:"yaml_path"`
+	Namespace   string `json:"namespace"`
+	Image       string `json:"image"`
+	StorageAddr string `json:"storage_addr"`
+	GatewayAddr string `json:"gateway_addr"`
+	// ImageRepo and ServiceAccount are used when the old bcs-k8s-watch is deleted by cleanup and not backed up
+	ImageRepo      string `json:"image_repo"`
+	ServiceAccount string `json:"service_account"`
 }
@@ -0,0 +1,156 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package options
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Redacted replacement of secrets in config dumps, logs, http debug output and reports
+const Redacted = "******"
+
+// secretEnvPrefix prefix of env vars holding secrets, NAME_FILE is the path of a file holding the secret
+const secretEnvPrefix = "UPGRADETOOL_"
+
+// minSecretLen secrets shorter than it are only redacted by patterns, short values would mangle other text
+const minSecretLen = 4
+
+// secretPatterns secrets whose values are unknown beforehand, e.g. access tokens got from bkssm
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(access_token=)[^&\s"']+`),
+	regexp.MustCompile(`(?i)(authorization:\s*bearer\s+)\S+`),
+	regexp.MustCompile(`(?i)(x-bk-app-secret:\s*)\S+`),
+	regexp.MustCompile(`(?i)("(?:access_token|app_secret|bk_app_secret|gateway_token|password|token)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`(://[^:/@\s]+:)[^@/\s]+(@)`),
+}
+
+var (
+	secretsLock sync.RWMutex
+	// secrets known values of secrets, longest first so that secrets containing others are replaced whole
+	secrets []string
+)
+
+// AddSecrets register values to redact, e.g. tokens discovered at runtime
+func AddSecrets(values ...string) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, v := range values {
+		if len(v) < minSecretLen {
+			continue
+		}
+		known := false
+		for _, s := range secrets {
+			known = known || s == v
+		}
+		if !known {
+			secrets = append(secrets, v)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replace registered secrets and secrets matching patterns in s
+func Redact(s string) string {
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	secretsLock.RUnlock()
+
+	for _, p := range secretPatterns {
+		s = p.ReplaceAllStringFunc(s, func(match string) string {
+			groups := p.FindStringSubmatch(match)
+			if len(groups) > 2 {
+				return groups[1] + Redacted + groups[2]
+			}
+			return groups[1] + Redacted
+		})
+	}
+	return s
+}
+
+// secretField secret in config and the env var overriding it
+type secretField struct {
+	env   string
+	value *string
+}
+
+func (op *UpgradeOption) secretFields() []secretField {
+	return []secretField{
+		{"MYSQL_DSN", &op.DSN},
+		{"MONGODB_PASSWORD", &op.MongoDB.Password},
+		{"BCS_API_TOKEN", &op.BCSApi.Token},
+		{"BCS_API_GATEWAY_TOKEN", &op.BCSApiGateway.Token},
+		{"BCS_CC_APP_SECRET", &op.BCSCc.AppSecret},
+		{"BCS_CC_BK_TOKEN", &op.BCSCc.BkToken},
+	}
+}
+
+// LoadSecrets override secrets in config by env vars UPGRADETOOL_<NAME>, or by the files named in
+// UPGRADETOOL_<NAME>_FILE, and register all secrets for redaction
+func (op *UpgradeOption) LoadSecrets() error {
+	for _, f := range op.secretFields() {
+		env := secretEnvPrefix + f.env
+		if value := os.Getenv(env); value != "" {
+			*f.value = value
+		} else if path := os.Getenv(env + "_FILE"); path != "" {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("read %s from %s failed, %v", env, path, err)
+			}
+			*f.value = strings.TrimSpace(string(data))
+		}
+		AddSecrets(*f.value)
+	}
+	if cfg, err := mysql.ParseDSN(op.DSN); err == nil {
+		AddSecrets(cfg.Passwd)
+	}
+	return nil
+}
+
+// Redacted copy of config with secrets replaced, the password in mysql_dsn is replaced and the rest kept
+func (op *UpgradeOption) Redacted() UpgradeOption {
+	redacted := *op
+	for _, f := range redacted.secretFields() {
+		if *f.value == "" {
+			continue
+		}
+		if f.value == &redacted.DSN {
+			redacted.DSN = redactDSN(redacted.DSN)
+			continue
+		}
+		*f.value = Redacted
+	}
+	return redacted
+}
+
+// redactDSN replace the password in dsn, dsn is replaced whole if it can not be parsed
+func redactDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return Redacted
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = Redacted
+	}
+	return cfg.FormatDSN()
+}